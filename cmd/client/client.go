@@ -2,11 +2,12 @@ package client
 
 import (
 	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -24,18 +25,22 @@ func Run(args []string) error {
 		Index:        "index.php",
 	}
 	host := "127.0.0.1:9000"
+	body := ""
 	env := ""
 	header := "{}"
+	filter := ""
 	help := false
 	fs := flag.NewFlagSet(Action, flag.ContinueOnError)
-	fs.StringVar(&host, "host", host, "php-fmp hostname")
+	fs.StringVar(&host, "host", host, "php-fmp hostname, unix:/path/to.sock for a unix socket")
 	fs.StringVar(&req.Method, "method", req.Method, "request method")
 	fs.StringVar(&rawUrl, "url", rawUrl, "request url")
 	fs.StringVar(&req.Index, "index", req.Index, "request index")
 	fs.StringVar(&req.DocumentRoot, "document-root", req.DocumentRoot, "request document root")
-	fs.StringVar(&req.Body, "body", req.Body, "request body")
+	fs.StringVar(&req.RemoteRoot, "fpm-root", req.RemoteRoot, "request document root as seen by php-fpm, when it differs from document-root")
+	fs.StringVar(&body, "body", body, "request body")
 	fs.StringVar(&env, "env", env, "request env as json or filename to env.json")
 	fs.StringVar(&header, "header", header, "request header as json or filename to header.json")
+	fs.StringVar(&filter, "filter", filter, "send the request with the filter role and this file as data")
 	fs.BoolVar(&help, "help", help, "print cmd help")
 	err := fs.Parse(args)
 	if err != nil {
@@ -45,27 +50,50 @@ func Run(args []string) error {
 		fs.PrintDefaults()
 		return nil
 	}
-	err = DecodeOrLoad(env, &req.Env)
+	envs := map[string]string{}
+	err = DecodeOrLoad(env, &envs)
 	if err != nil {
 		return fmt.Errorf("cannot read env data : %w", err)
 	}
+	req.Env = fcgiprotocol.ParamsFromMap(envs)
 
-	err = DecodeOrLoad(header, &req.Header)
+	headers := map[string]string{}
+	err = DecodeOrLoad(header, &headers)
 	if err != nil {
 		return fmt.Errorf("cannot read env data : %w", err)
 	}
+	req.Header = http.Header{}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	req.Body = strings.NewReader(body)
 
 	req.Url, err = url.Parse(rawUrl)
 	if err != nil {
 		return fmt.Errorf("cannot parse input url : %w", err)
 	}
 
-	conn, err := net.Dial("tcp", host)
+	if filter != "" {
+		f, err := os.Open(filter)
+		if err != nil {
+			return fmt.Errorf("cannot open filtered file : %w", err)
+		}
+		defer f.Close()
+		req, err = fcgiclient.FilterFile(req, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, err := fcgiclient.DialAddr(host)()
 	if err != nil {
 		return fmt.Errorf("cannot dial php server : %w", err)
 	}
 	defer conn.Close()
 
+	// a script exiting with a non zero status still has its response
+	// printed, its *fcgiprotocol.AppError comes along
 	resp, err := fcgiclient.Do(conn, req)
 	fmt.Printf("%#v\n", resp)
 	return err
@@ -85,6 +113,7 @@ func DecodeOrLoad(filename string, data interface{}) error {
 				errors.Join(err, errJson),
 			)
 		}
+		return nil
 	}
 	defer f.Close()
 	err = json.NewDecoder(f).Decode(data)
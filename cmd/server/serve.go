@@ -2,14 +2,19 @@ package server
 
 import (
 	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgiproxy"
 	"app/pkg/http/handler"
 	"app/pkg/http/middleware"
+	"app/pkg/server"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 )
 
 const Action = "server"
@@ -19,99 +24,292 @@ func Run(args []string) error {
 	cwd, _ := os.Getwd()
 	listen := "localhost:8080"
 	srv := Server{
-		DocumentRoot: cwd,
-		FCGIHost:     "127.0.0.1:9000",
-		Index:        "index.php",
-		IP:           "127.0.0.1",
-		Name:         "localhost",
-		Port:         "443",
+		DocumentRoot:  cwd,
+		FCGIHost:      "127.0.0.1:9000",
+		Index:         "index.php",
+		IP:            "127.0.0.1",
+		Name:          "localhost",
+		Port:          "443",
+		MaxIdleConns:  fcgiclient.DefaultMaxIdleConns,
+		IdleTimeout:   fcgiclient.DefaultIdleTimeout,
+		MaxParamsLen:  fcgiprotocol.MaxParamsLen,
+		SplitPathInfo: fcgiclient.DefaultSplitPathInfo.String(),
+		AuthIndex:     "auth.php",
+		FilterIndex:   "filter.php",
 	}
+	dirIndex := "index.php"
+	authPaths := ""
+	filterExt := ".md"
 	fs := flag.NewFlagSet(Action, flag.ContinueOnError)
 	fs.StringVar(&srv.DocumentRoot, "document-root", srv.DocumentRoot, "The document root to serve files from")
-	fs.StringVar(&listen, "listen", listen, "The webserver bind address to listen to.")
+	fs.StringVar(&srv.FPMRoot, "fpm-root", srv.FPMRoot, "The document root as seen by php-fpm, when it differs from document-root.")
+	fs.StringVar(&listen, "listen", listen, "The webserver bind address to listen to, unix:/path/to.sock for a unix socket.")
 	fs.StringVar(&srv.IP, "srv-ip", srv.IP, "The webserver ip passed to php-fpm.")
 	fs.StringVar(&srv.Name, "srv-name", srv.Name, "The webserver name passed to php-fpm.")
 	fs.StringVar(&srv.Port, "srv-port", srv.Port, "The webserver port passed to php-fpm.")
-	fs.StringVar(&srv.FCGIHost, "server", srv.FCGIHost, "The FastCGI Server to listen to")
+	fs.StringVar(&srv.FCGIHost, "server", srv.FCGIHost, "The FastCGI Server to listen to, unix:/path/to.sock for a unix socket.")
 	fs.StringVar(&srv.Index, "index", srv.Index, "The default script to call when path cannot be served by existing file.")
+	fs.StringVar(&dirIndex, "dir-index", dirIndex, "Comma separated list of the scripts run for a folder.")
+	fs.IntVar(&srv.MaxIdleConns, "max-idle-conns", srv.MaxIdleConns, "The number of idle connections kept open to the FastCGI Server, 0 disable pooling.")
+	fs.DurationVar(&srv.IdleTimeout, "idle-timeout", srv.IdleTimeout, "How long an idle connection to the FastCGI Server is kept open.")
+	fs.IntVar(&srv.MaxParamsLen, "max-params-len", srv.MaxParamsLen, "The maximum encoded size of the params sent to the FastCGI Server.")
+	fs.StringVar(&srv.SplitPathInfo, "split-path-info", srv.SplitPathInfo, "The regular expression capturing the script and PATH_INFO from the url path, empty to disable.")
+	fs.BoolVar(&srv.Multiplex, "multiplex", srv.Multiplex, "Send concurrent requests over a single connection to the FastCGI Server.")
+	fs.StringVar(&srv.AuthHost, "auth-server", srv.AuthHost, "The FastCGI authorizer asked about requests before they are sent to the FastCGI Server, empty to disable.")
+	fs.StringVar(&srv.AuthIndex, "auth-index", srv.AuthIndex, "The script of the authorizer.")
+	fs.StringVar(&srv.AuthRoot, "auth-root", srv.AuthRoot, "The document root of the authorizer script, default to fpm-root.")
+	fs.StringVar(&authPaths, "auth-paths", authPaths, "Comma separated list of the url path prefixes guarded by the authorizer, empty for all.")
+	fs.StringVar(&srv.FilterHost, "filter-server", srv.FilterHost, "The FastCGI filter static files are run through before being served, empty to disable.")
+	fs.StringVar(&srv.FilterIndex, "filter-index", srv.FilterIndex, "The script of the filter.")
+	fs.StringVar(&srv.FilterRoot, "filter-root", srv.FilterRoot, "The document root of the filter script, default to fpm-root.")
+	fs.StringVar(&filterExt, "filter-ext", filterExt, "Comma separated list of the extensions of the filtered files, empty for all.")
 
 	err := fs.Parse(args)
 	if err != nil {
 		return fmt.Errorf("cannot parse argument : %w", err)
 	}
+	if dirIndex != "" {
+		srv.DirIndex = strings.Split(dirIndex, ",")
+	}
+	if authPaths != "" {
+		srv.AuthPaths = strings.Split(authPaths, ",")
+	}
+	if filterExt != "" {
+		srv.FilterExt = strings.Split(filterExt, ",")
+	}
+	if _, err := regexp.Compile(srv.SplitPathInfo); err != nil {
+		return fmt.Errorf("cannot parse split-path-info : %w", err)
+	}
 
 	fmt.Printf("Listening on http://%s\n", listen)
 	fmt.Printf("Document root is %s\n", srv.DocumentRoot)
 	fmt.Printf("Press Ctrl-C to quit.\n")
 
+	listener, err := server.Listen(fcgiclient.ParseAddr(listen))
+	if err != nil {
+		return fmt.Errorf("cannot listen : %w", err)
+	}
+	defer listener.Close()
 	http.HandleFunc("/", middleware.HandleWithLogAndError(handle(srv)))
-	http.ListenAndServe(listen, nil)
-	return nil
+	return http.Serve(listener, nil)
 }
 
 type Server struct {
 	DocumentRoot string
+	// FPMRoot is DocumentRoot in the filesystem of php-fpm, empty when
+	// they share it.
+	FPMRoot      string
 	Index        string
 	FCGIHost     string
 	IP           string
 	Name         string
 	Port         string
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+	Multiplex    bool
+	// MaxParamsLen caps the encoded size of the params sent to the
+	// FastCGI servers, fcgiprotocol.MaxParamsLen when zero.
+	MaxParamsLen int
+	// DirIndex are the scripts tried, in order, when the url names a
+	// folder.
+	DirIndex []string
+	// SplitPathInfo is the regular expression splitting PATH_INFO from the
+	// url path, empty disables it.
+	SplitPathInfo string
+	// AuthHost is the address of an FCGI_AUTHORIZER application asked
+	// about the requests of AuthPaths, all of them when empty, before
+	// they are sent to FCGIHost. Empty disables it.
+	AuthHost  string
+	AuthIndex string
+	// AuthRoot is the document root of AuthIndex, the one of php-fpm when
+	// empty.
+	AuthRoot  string
+	AuthPaths []string
+	// FilterHost is the address of an FCGI_FILTER application the static
+	// files with one of FilterExt, all of them when empty, are run
+	// through. Empty disables it.
+	FilterHost  string
+	FilterIndex string
+	// FilterRoot is the document root of FilterIndex, the one of php-fpm
+	// when empty.
+	FilterRoot string
+	FilterExt  []string
 }
 
 func handle(srv Server) func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	sh := handler.Static(srv.DocumentRoot, srv.Index)
-	fh := fcgiHandler(srv)
-	return func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	sh := handler.Static(srv.DocumentRoot, srv.Index, srv.DirIndex...)
+	proxy := newProxy(srv)
+	var filter *fcgiproxy.Filter
+	if srv.FilterHost != "" {
+		filter = newFilter(srv)
+	}
+	// the authorizer guards static and filtered files as well as php
+	serve := guard(srv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filter != nil && filter.Match(r.URL.Path) {
+			filter.ServeHTTP(w, r)
+			return
+		}
 		if ok := sh(w, r); ok {
-			return nil, nil
+			return
 		}
-		return fh(w, r)
-	}
+		proxy.ServeHTTP(w, r)
+	}))
+	// local redirects can point to static files too
+	proxy.LocalRedirect = serve
+	return withRequestLog(serve)
 }
 
+// fcgiHandler sends every request to php.
 func fcgiHandler(srv Server) func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	proxy := newProxy(srv)
+	serve := guard(srv, proxy)
+	// the target of a local redirect is authorized on its own
+	proxy.LocalRedirect = serve
+	return withRequestLog(serve)
+}
+
+// guard puts the authorizer in front of next when there is one.
+func guard(srv Server, next http.Handler) http.Handler {
+	if srv.AuthHost == "" {
+		return next
+	}
+	return newAuthorizer(srv).Guard(next)
+}
+
+// requestLog collects the stderr and the error of a request and of the
+// local redirects it leads to.
+type requestLog struct {
+	stderr []byte
+	err    error
+}
+
+type requestLogKey struct{}
+
+func getRequestLog(r *http.Request) *requestLog {
+	if l, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		return l
+	}
+	return &requestLog{}
+}
+
+// withRequestLog returns what php wrote on stderr along with the error the
+// response could not report, as HandleWithLogAndError expects.
+func withRequestLog(next http.Handler) func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	return func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-		defer r.Body.Close()
-		rBody, err := io.ReadAll(r.Body)
-		if err != nil {
-			return nil, fmt.Errorf("cannot read request body: %v", err)
-		}
+		l := &requestLog{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l)))
+		return l.stderr, l.err
+	}
+}
 
-		remoteAddr, remotePort := splitIPAndPort(r.RemoteAddr)
-
-		req := fcgiclient.Request{
-			DocumentRoot: srv.DocumentRoot,
-			Index:        srv.Index,
-			Method:       r.Method,
-			Url:          r.URL,
-			Body:         string(rBody),
-			Header:       map[string]string{},
-			Env: map[string]string{
-				"REMOTE_ADDR": remoteAddr,
-				"REMOTE_PORT": remotePort,
-				"SERVER_ADDR": srv.IP,
-				"SERVER_NAME": srv.Name,
-				"SERVER_PORT": srv.Port,
+func newProxy(srv Server) *fcgiproxy.Handler {
+	splitPath := fcgiproxy.TryFiles(srv.DocumentRoot, srv.DirIndex...)
+	if srv.SplitPathInfo != "" {
+		splitPath = firstSplit(splitPath, fcgiclient.SplitPathInfo(srv.DocumentRoot, regexp.MustCompile(srv.SplitPathInfo)))
+	}
+	proxy := &fcgiproxy.Handler{
+		Backend: fcgiproxy.Backend{
+			Client: &fcgiclient.Client{
+				Dial:         fcgiclient.DialAddr(srv.FCGIHost),
+				MaxIdleConns: srv.MaxIdleConns,
+				IdleTimeout:  srv.IdleTimeout,
+				Multiplex:    srv.Multiplex,
+				MaxParamsLen: srv.MaxParamsLen,
 			},
-		}
+		},
+		DocumentRoot: srv.DocumentRoot,
+		RemoteRoot:   srv.FPMRoot,
+		Index:        srv.Index,
+		SplitPath:    splitPath,
+		Server: fcgiclient.ServerInfo{
+			Addr: srv.IP,
+			Name: srv.Name,
+			Port: srv.Port,
+		},
+		Stderr: func(r *http.Request, b []byte) {
+			l := getRequestLog(r)
+			l.stderr = append(l.stderr, b...)
+		},
+		ErrorHandler: errorHandler,
+		ErrorLog: func(r *http.Request, err error) {
+			getRequestLog(r).err = err
+		},
+	}
+	return proxy
+}
 
-		for name, values := range r.Header {
-			req.Header[name] = values[0]
+// firstSplit returns the split of the first of splits matching the path.
+func firstSplit(splits ...fcgiclient.SplitPathFunc) fcgiclient.SplitPathFunc {
+	return func(urlPath string) (string, string, bool) {
+		for _, split := range splits {
+			if script, pathInfo, ok := split(urlPath); ok {
+				return script, pathInfo, true
+			}
 		}
+		return "", "", false
+	}
+}
 
-		conn, err := net.Dial("tcp", srv.FCGIHost)
-		if err != nil {
-			return nil, fmt.Errorf("cannot dial php server : %w", err)
-		}
-		defer conn.Close()
+func newAuthorizer(srv Server) *fcgiproxy.Authorizer {
+	return &fcgiproxy.Authorizer{
+		Backend: fcgiproxy.Backend{
+			Client: &fcgiclient.Client{
+				Dial:         fcgiclient.DialAddr(srv.AuthHost),
+				MaxIdleConns: srv.MaxIdleConns,
+				IdleTimeout:  srv.IdleTimeout,
+				MaxParamsLen: srv.MaxParamsLen,
+			},
+		},
+		DocumentRoot: srv.scriptRoot(srv.AuthRoot),
+		Index:        srv.AuthIndex,
+		Paths:        srv.AuthPaths,
+		Server: fcgiclient.ServerInfo{
+			Addr: srv.IP,
+			Name: srv.Name,
+			Port: srv.Port,
+		},
+		ErrorHandler: errorHandler,
+	}
+}
 
-		rsp, err := fcgiclient.Do(conn, req)
-		if err != nil {
-			return nil, fmt.Errorf("cannot make request to php : %v", err)
-		}
+func newFilter(srv Server) *fcgiproxy.Filter {
+	return &fcgiproxy.Filter{
+		Backend: fcgiproxy.Backend{
+			Client: &fcgiclient.Client{
+				Dial:         fcgiclient.DialAddr(srv.FilterHost),
+				MaxIdleConns: srv.MaxIdleConns,
+				IdleTimeout:  srv.IdleTimeout,
+				MaxParamsLen: srv.MaxParamsLen,
+			},
+		},
+		DocumentRoot: srv.DocumentRoot,
+		ScriptRoot:   srv.scriptRoot(srv.FilterRoot),
+		Index:        srv.FilterIndex,
+		Extensions:   srv.FilterExt,
+		Server: fcgiclient.ServerInfo{
+			Addr: srv.IP,
+			Name: srv.Name,
+			Port: srv.Port,
+		},
+		ErrorHandler: errorHandler,
+	}
+}
 
-		middleware.Respond(w, rsp.Stdout, rsp.StatusCode, rsp.Header)
+// errorHandler hands err to HandleWithLogAndError, which logs it, and
+// answers with the status fcgiproxy picks for it.
+func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	getRequestLog(r).err = err
+	statusCode := fcgiproxy.ErrorStatus(err)
+	middleware.Respond(w, strings.ToLower(http.StatusText(statusCode)), statusCode, nil)
+}
 
-		return []byte(rsp.Stderr), nil
+// scriptRoot is root, or the document root of php-fpm when empty.
+func (srv Server) scriptRoot(root string) string {
+	if root != "" {
+		return root
+	}
+	if srv.FPMRoot != "" {
+		return srv.FPMRoot
 	}
+	return srv.DocumentRoot
 }
@@ -1,33 +1,22 @@
 package server
 
 import (
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"app/pkg/http/middleware"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"os/exec"
 	"path"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
-	"time"
 )
 
-func runPhpFpmServer(t *testing.T) (string, func() error) {
-	t.Helper()
-	cwd, _ := os.Getwd()
-	cwd = path.Join(cwd, "../../php-fpm")
-	t.Logf("dir is %s", cwd)
-	// binary can be downloaded from https://dl.static-php.dev/static-php-cli/common/
-	cmd := exec.Command("./php-fpm", "-y", path.Join(cwd, "php-fpm.conf"), "-p", cwd)
-	cmd.Dir = cwd
-	err := cmd.Start()
-	if err != nil {
-		t.Fatalf("cannot start php-fpm : %v", err)
-	}
-	time.Sleep(time.Second)
-	return cwd, cmd.Process.Kill
-}
-
 type Request struct {
 	Method string
 	URL    string
@@ -42,12 +31,9 @@ type Response struct {
 }
 
 func TestDo(t *testing.T) {
-	dir, closer := runPhpFpmServer(t)
-	defer func() {
-		if err := closer(); err != nil {
-			t.Fatalf("failed to kill process: %v", err)
-		}
-	}()
+	srv := fcgitest.NewServer(fcgitest.EchoHandler)
+	defer srv.Close()
+	dir := fcgitest.DocumentRoot(t)
 
 	tests := map[string]struct {
 		In       Request
@@ -88,9 +74,7 @@ func TestDo(t *testing.T) {
 				}, "\n"),
 				Header: map[string]string{
 					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
 					"X-Request-Uri": "/test?status_code=201",
-					"Status":        "201 Created",
 					"X-Status-Code": "201",
 					"Status-Code":   "201",
 				},
@@ -102,7 +86,7 @@ func TestDo(t *testing.T) {
 	h := fcgiHandler(Server{
 		DocumentRoot: dir,
 		Index:        "index.php",
-		FCGIHost:     "127.0.0.1:9000",
+		FCGIHost:     srv.Addr,
 		IP:           "1.2.3.4",
 		Name:         "localhost",
 		Port:         "443",
@@ -148,3 +132,531 @@ func TestDo(t *testing.T) {
 		})
 	}
 }
+
+// runChunkedServer answers with a header block, a first chunk and, once
+// unblock is closed, a second chunk.
+func runChunkedServer(t *testing.T, headers string, unblock <-chan struct{}) string {
+	t.Helper()
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		fmt.Fprint(w, headers+"\r\n\r\nfirst\n")
+		<-unblock
+		fmt.Fprint(w, "second\n")
+	})
+	t.Cleanup(srv.Close)
+	return srv.Addr
+}
+
+func TestStreamResponse(t *testing.T) {
+	tests := map[string]struct {
+		Headers       string
+		Streamed      bool
+		ContentLength int64
+	}{
+		"streamed by default": {
+			Headers:       "Content-type: text/event-stream",
+			Streamed:      true,
+			ContentLength: -1,
+		},
+		"buffered on demand": {
+			Headers:       "Content-type: text/plain\r\nX-Accel-Buffering: yes",
+			Streamed:      false,
+			ContentLength: int64(len("first\nsecond\n")),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			unblock := make(chan struct{})
+			addr := runChunkedServer(t, tt.Headers, unblock)
+			h := fcgiHandler(Server{Index: "index.php", FCGIHost: addr})
+			ts := httptest.NewServer(http.HandlerFunc(middleware.HandleWithLogAndError(h)))
+			defer ts.Close()
+
+			if !tt.Streamed {
+				close(unblock)
+			}
+			rsp, err := http.Get(ts.URL + "/events")
+			if err != nil {
+				t.Fatalf("cannot get response : %v", err)
+			}
+			defer rsp.Body.Close()
+			if tt.Streamed {
+				first := make([]byte, len("first\n"))
+				if _, err := io.ReadFull(rsp.Body, first); err != nil {
+					t.Fatalf("cannot read first chunk before the end of the script : %v", err)
+				}
+				close(unblock)
+			}
+			if rsp.ContentLength != tt.ContentLength {
+				t.Fatalf("want content length %d got %d", tt.ContentLength, rsp.ContentLength)
+			}
+			if rsp.Header.Get("X-Accel-Buffering") != "" {
+				t.Fatalf("X-Accel-Buffering header should not be forwarded")
+			}
+			rest, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if !strings.HasSuffix(string(rest), "second\n") {
+				t.Fatalf("unexpected body end %s", rest)
+			}
+		})
+	}
+}
+
+func TestRepeatedResponseHeaders(t *testing.T) {
+	unblock := make(chan struct{})
+	close(unblock)
+	addr := runChunkedServer(t, "Set-Cookie: a=1\r\nSet-Cookie: b=2\r\nVary: Origin\r\nVary: Accept-Encoding", unblock)
+	h := fcgiHandler(Server{Index: "index.php", FCGIHost: addr})
+	ts := httptest.NewServer(http.HandlerFunc(middleware.HandleWithLogAndError(h)))
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + "/login")
+	if err != nil {
+		t.Fatalf("cannot get response : %v", err)
+	}
+	defer rsp.Body.Close()
+	if got := rsp.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, []string{"a=1", "b=2"}) {
+		t.Fatalf("want both cookies got %#v", got)
+	}
+	if got := rsp.Header.Values("Vary"); !reflect.DeepEqual(got, []string{"Origin", "Accept-Encoding"}) {
+		t.Fatalf("want both vary values got %#v", got)
+	}
+}
+
+// runScriptServer answers each request with the output of script.
+func runScriptServer(t *testing.T, script func(env map[string]string) string) string {
+	t.Helper()
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		fmt.Fprint(w, script(r.Env))
+	})
+	t.Cleanup(srv.Close)
+	return srv.Addr
+}
+
+func TestCGIRedirect(t *testing.T) {
+	addr := runScriptServer(t, func(env map[string]string) string {
+		switch env["REQUEST_URI"] {
+		case "/local":
+			return "Location: /target?from=local\n\n"
+		case "/loop":
+			return "Location: /loop\n\n"
+		case "/client":
+			return "Location: https://exemple.com/\n\n"
+		case "/malformed":
+			return "Content-Type text/plain\n\n"
+		}
+		return "Content-Type: text/plain\n\n" + env["REQUEST_METHOD"] + " " + env["REQUEST_URI"] + " " + env["CONTENT_LENGTH"]
+	})
+	h := handle(Server{DocumentRoot: t.TempDir(), Index: "index.php", FCGIHost: addr})
+	ts := httptest.NewServer(http.HandlerFunc(middleware.HandleWithLogAndError(h)))
+	defer ts.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := map[string]struct {
+		Path       string
+		StatusCode int
+		Location   string
+		Body       string
+	}{
+		"local redirect is served as a get": {
+			Path:       "/local",
+			StatusCode: http.StatusOK,
+			Body:       "GET /target?from=local 0",
+		},
+		"client redirect": {
+			Path:       "/client",
+			StatusCode: http.StatusFound,
+			Location:   "https://exemple.com/",
+		},
+		"redirect loop": {
+			Path:       "/loop",
+			StatusCode: http.StatusBadGateway,
+			Body:       "bad gateway",
+		},
+		"malformed header": {
+			Path:       "/malformed",
+			StatusCode: http.StatusBadGateway,
+			Body:       "bad gateway",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rsp, err := client.Post(ts.URL+tt.Path, "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("cannot get response : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, rsp.StatusCode)
+			}
+			if rsp.Header.Get("Location") != tt.Location {
+				t.Fatalf("want location '%s' got '%s'", tt.Location, rsp.Header.Get("Location"))
+			}
+			if tt.Body != "" && string(body) != tt.Body {
+				t.Fatalf("want body '%s' got '%s'", tt.Body, body)
+			}
+		})
+	}
+}
+
+func TestPathInfo(t *testing.T) {
+	addr := runScriptServer(t, func(env map[string]string) string {
+		return "Content-Type: text/plain\n\n" + strings.Join([]string{
+			env["SCRIPT_FILENAME"],
+			env["SCRIPT_NAME"],
+			env["PATH_INFO"],
+			env["PATH_TRANSLATED"],
+		}, " ")
+	})
+	dir := fcgitest.DocumentRoot(t)
+	if err := os.WriteFile(path.Join(dir, "app.php"), nil, 0o644); err != nil {
+		t.Fatalf("cannot create app.php : %v", err)
+	}
+
+	tests := map[string]struct {
+		SplitPathInfo string
+		FPMRoot       string
+		Path          string
+		Body          string
+	}{
+		"split": {
+			SplitPathInfo: `^(.+\.php)(/.+)$`,
+			Path:          "/app.php/users/42",
+			Body:          path.Join(dir, "app.php") + " /app.php /users/42 " + path.Join(dir, "users/42"),
+		},
+		"disabled": {
+			SplitPathInfo: "",
+			Path:          "/app.php/users/42",
+			Body:          path.Join(dir, "index.php") + " /index.php  ",
+		},
+		"fpm root": {
+			SplitPathInfo: `^(.+\.php)(/.+)$`,
+			FPMRoot:       "/var/www/html",
+			Path:          "/app.php/users/42",
+			Body:          "/var/www/html/app.php /app.php /users/42 /var/www/html/users/42",
+		},
+		"fpm root with script": {
+			SplitPathInfo: `^(.+\.php)(/.+)$`,
+			FPMRoot:       "/var/www/html",
+			Path:          "/app.php",
+			Body:          "/var/www/html/app.php /app.php  ",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := handle(Server{DocumentRoot: dir, FPMRoot: tt.FPMRoot, Index: "index.php", DirIndex: []string{"index.php"}, FCGIHost: addr, SplitPathInfo: tt.SplitPathInfo})
+			rr := httptest.NewRecorder()
+			_, err := h(rr, httptest.NewRequest("GET", tt.Path, nil))
+			if err != nil {
+				t.Fatalf("failed send fcgi request: %v", err)
+			}
+			if rr.Body.String() != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestScriptResolution(t *testing.T) {
+	addr := runScriptServer(t, func(env map[string]string) string {
+		return "Content-Type: text/plain\n\n" + env["SCRIPT_FILENAME"] + " " + env["SCRIPT_NAME"]
+	})
+	dir := fcgitest.DocumentRoot(t)
+	for _, name := range []string{"admin/tools.php", "admin/index.php", "docs/index.html"} {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0o755); err != nil {
+			t.Fatalf("cannot create folder of %s : %v", name, err)
+		}
+		if err := os.WriteFile(path.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("cannot create %s : %v", name, err)
+		}
+	}
+	h := handle(Server{DocumentRoot: dir, Index: "index.php", DirIndex: []string{"index.php"}, FCGIHost: addr})
+
+	tests := map[string]struct {
+		Path string
+		Body string
+	}{
+		"requested script": {
+			Path: "/admin/tools.php",
+			Body: path.Join(dir, "admin/tools.php") + " /admin/tools.php",
+		},
+		"folder index": {
+			Path: "/admin/",
+			Body: path.Join(dir, "admin/index.php") + " /admin/index.php",
+		},
+		"static folder index": {
+			Path: "/docs/",
+			Body: "docs/index.html",
+		},
+		"front controller": {
+			Path: "/api/users",
+			Body: path.Join(dir, "index.php") + " /index.php",
+		},
+		"missing script": {
+			Path: "/admin/missing.php",
+			Body: path.Join(dir, "index.php") + " /index.php",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			_, err := h(rr, httptest.NewRequest("GET", tt.Path, nil))
+			if err != nil {
+				t.Fatalf("failed send fcgi request: %v", err)
+			}
+			if rr.Body.String() != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		switch r.Env["REQUEST_URI"] {
+		case "/overloaded":
+			w.ProtocolStatus = fcgiprotocol.FCGI_OVERLOADED
+		case "/fatal":
+			fmt.Fprint(w.Stderr, "PHP Fatal error")
+			fmt.Fprint(w, "Content-Type: text/plain\r\nX-Accel-Buffering: yes\r\n\r\nfatal")
+			w.AppStatus = 255
+		}
+	})
+	defer srv.Close()
+	unreachable := fcgitest.NewServer(fcgitest.EchoHandler)
+	unreachable.Close()
+
+	tests := map[string]struct {
+		Host         string
+		MaxParamsLen int
+		Path         string
+		StatusCode   int
+		Error        error
+		AppStatus    uint32
+	}{
+		"params too long": {
+			MaxParamsLen: 64,
+			Path:         "/" + strings.Repeat("a", 64),
+			StatusCode:   http.StatusRequestHeaderFieldsTooLarge,
+		},
+		"unreachable server": {
+			Host:       unreachable.Addr,
+			Path:       "/",
+			StatusCode: http.StatusBadGateway,
+			Error:      syscall.ECONNREFUSED,
+		},
+		"overloaded": {
+			Path:       "/overloaded",
+			StatusCode: http.StatusServiceUnavailable,
+			Error:      fcgiprotocol.ErrOverloaded,
+		},
+		"fatal error": {
+			Path:       "/fatal",
+			StatusCode: http.StatusInternalServerError,
+			AppStatus:  255,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			host := srv.Addr
+			if tt.Host != "" {
+				host = tt.Host
+			}
+			h := fcgiHandler(Server{Index: "index.php", FCGIHost: host, MaxParamsLen: tt.MaxParamsLen})
+			var gotErr error
+			ts := httptest.NewServer(http.HandlerFunc(middleware.HandleWithLogAndError(func(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+				stderr, err := h(w, r)
+				gotErr = err
+				return stderr, err
+			})))
+			defer ts.Close()
+			rsp, err := http.Get(ts.URL + tt.Path)
+			if err != nil {
+				t.Fatalf("cannot get response : %v", err)
+			}
+			rsp.Body.Close()
+			if rsp.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, rsp.StatusCode)
+			}
+			var appErr *fcgiprotocol.AppError
+			var tooLong *fcgiprotocol.PairTooLongError
+			if tt.MaxParamsLen != 0 {
+				if !errors.As(gotErr, &tooLong) || tooLong.Field != "params" || tooLong.Max != tt.MaxParamsLen {
+					t.Fatalf("want params over %d got %v", tt.MaxParamsLen, gotErr)
+				}
+			} else if tt.AppStatus != 0 {
+				if !errors.As(gotErr, &appErr) || appErr.AppStatus != tt.AppStatus {
+					t.Fatalf("want app error with status %d got %v", tt.AppStatus, gotErr)
+				}
+			} else if !errors.Is(gotErr, tt.Error) {
+				t.Fatalf("want error %v got %v", tt.Error, gotErr)
+			}
+		})
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	auth := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		if r.Env["SCRIPT_FILENAME"] != "/srv/auth/check.php" || r.Env["HTTP_COOKIE"] != "session=ok" {
+			fmt.Fprint(w, "Status: 401 Unauthorized\r\n\r\nlogin first")
+			return
+		}
+		fmt.Fprint(w, "Variable-Remote-User: bob\r\n\r\n")
+	})
+	defer auth.Close()
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		fmt.Fprintf(w, "Content-Type: text/plain\r\n\r\n%s", r.Env["REMOTE_USER"])
+	})
+	defer srv.Close()
+	root := t.TempDir()
+	if err := os.Mkdir(path.Join(root, "admin"), 0o755); err != nil {
+		t.Fatalf("cannot create folder : %v", err)
+	}
+	if err := os.WriteFile(path.Join(root, "admin", "report.pdf"), []byte("report"), 0o644); err != nil {
+		t.Fatalf("cannot write file : %v", err)
+	}
+	h := handle(Server{
+		DocumentRoot: root,
+		Index:        "index.php",
+		FCGIHost:     srv.Addr,
+		AuthHost:     auth.Addr,
+		AuthIndex:    "check.php",
+		AuthRoot:     "/srv/auth",
+		AuthPaths:    []string{"/admin/", "/api/"},
+	})
+	ts := httptest.NewServer(http.HandlerFunc(middleware.HandleWithLogAndError(h)))
+	defer ts.Close()
+
+	tests := map[string]struct {
+		Path       string
+		Cookie     string
+		StatusCode int
+		Body       string
+	}{
+		"allowed": {
+			Path:       "/api/users",
+			Cookie:     "session=ok",
+			StatusCode: http.StatusOK,
+			Body:       "bob",
+		},
+		"denied": {
+			Path:       "/admin/",
+			StatusCode: http.StatusUnauthorized,
+			Body:       "login first",
+		},
+		"public": {
+			Path:       "/blog",
+			StatusCode: http.StatusOK,
+			Body:       "",
+		},
+		"denied static file": {
+			Path:       "/admin/report.pdf",
+			StatusCode: http.StatusUnauthorized,
+			Body:       "login first",
+		},
+		"allowed static file": {
+			Path:       "/admin/report.pdf",
+			Cookie:     "session=ok",
+			StatusCode: http.StatusOK,
+			Body:       "report",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+tt.Path, nil)
+			if err != nil {
+				t.Fatalf("cannot build request : %v", err)
+			}
+			if tt.Cookie != "" {
+				req.Header.Set("Cookie", tt.Cookie)
+			}
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("cannot get response : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, rsp.StatusCode)
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	filter := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		fmt.Fprintf(w, "Content-Type: text/html\r\n\r\n<p>%s</p>", r.Data)
+	})
+	defer filter.Close()
+	root := t.TempDir()
+	for name, content := range map[string]string{"page.md": "hello", "page.txt": "plain"} {
+		if err := os.WriteFile(path.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("cannot write file : %v", err)
+		}
+	}
+	h := handle(Server{
+		DocumentRoot: root,
+		Index:        "index.php",
+		FCGIHost:     "127.0.0.1:1",
+		FilterHost:   filter.Addr,
+		FilterIndex:  "markdown.php",
+		FilterExt:    []string{".md"},
+	})
+	ts := httptest.NewServer(http.HandlerFunc(middleware.HandleWithLogAndError(h)))
+	defer ts.Close()
+
+	tests := map[string]struct {
+		Path string
+		Body string
+	}{
+		"filtered": {
+			Path: "/page.md",
+			Body: "<p>hello</p>",
+		},
+		"static": {
+			Path: "/page.txt",
+			Body: "plain",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rsp, err := http.Get(ts.URL + tt.Path)
+			if err != nil {
+				t.Fatalf("cannot get response : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatalf("want status 200 got %d", rsp.StatusCode)
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package sniff
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxExchangeLen is how many bytes of records an exchange keeps to be
+// logged, a peer never ending its streams cannot make sniff run out of
+// memory. The params of a request always fit.
+const maxExchangeLen = 4 << 20
+
+// exchange is a request and its response as they went through the proxy.
+type exchange struct {
+	request  []fcgiprotocol.Record
+	response []fcgiprotocol.Record
+	filter   bool
+	// stdinDone and dataDone are set by the empty record ending the
+	// stream, responseDone by FCGI_END_REQUEST.
+	stdinDone    bool
+	dataDone     bool
+	aborted      bool
+	responseDone bool
+	// the lengths of the streams are counted apart, the records over
+	// maxExchangeLen are not kept
+	stdinLen int
+	dataLen  int
+	buffered int
+	dropped  int
+}
+
+// keep appends rec to records unless the exchange already holds
+// maxExchangeLen bytes.
+func (x *exchange) keep(records []fcgiprotocol.Record, rec fcgiprotocol.Record, max int) []fcgiprotocol.Record {
+	size := 8 + len(rec.Buf)
+	if x.buffered+size > max {
+		x.dropped += size
+		return records
+	}
+	x.buffered += size
+	return append(records, rec)
+}
+
+func (x *exchange) requestDone() bool {
+	return x.aborted || x.stdinDone && (!x.filter || x.dataDone)
+}
+
+// exchanges logs the exchanges of one connection once both their request
+// and their response are over. Records are given as they are copied, from
+// both directions at the same time, and are grouped by request id so the
+// requests of an application multiplexing the connection are logged apart.
+// Management records, on request id 0, are logged as they come.
+type exchanges struct {
+	printf Printf
+	decode bool
+	// max is the maxExchangeLen of the exchanges when set
+	max int
+
+	mu      sync.Mutex
+	current map[uint16]*exchange
+}
+
+func (e *exchanges) fromClient(rec fcgiprotocol.Record) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := rec.Header.Id
+	if id == uint16(fcgiprotocol.FCGI_NULL_REQUEST_ID) {
+		e.print("management request read raw %s", []fcgiprotocol.Record{rec})
+		return
+	}
+	if rec.Header.Type == fcgiprotocol.FCGI_BEGIN_REQUEST {
+		// the previous request with this id was not finished
+		e.flush(id)
+	}
+	x := e.get(id)
+	if rec.Header.Type == fcgiprotocol.FCGI_BEGIN_REQUEST {
+		x.filter = len(rec.Content()) >= 2 && rec.Content()[1] == fcgiprotocol.FCGI_FILTER
+	}
+	x.request = x.keep(x.request, rec, e.maxLen())
+	switch rec.Header.Type {
+	case fcgiprotocol.FCGI_STDIN:
+		x.stdinDone = x.stdinDone || len(rec.Content()) == 0
+		x.stdinLen += len(rec.Content())
+	case fcgiprotocol.FCGI_DATA:
+		x.dataDone = x.dataDone || len(rec.Content()) == 0
+		x.dataLen += len(rec.Content())
+	case fcgiprotocol.FCGI_ABORT_REQUEST:
+		x.aborted = true
+	}
+	if x.requestDone() && x.responseDone {
+		e.flush(id)
+	}
+}
+
+func (e *exchanges) fromServer(rec fcgiprotocol.Record) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := rec.Header.Id
+	if id == uint16(fcgiprotocol.FCGI_NULL_REQUEST_ID) {
+		e.print("management response read raw %s", []fcgiprotocol.Record{rec})
+		return
+	}
+	x := e.get(id)
+	if rec.Header.Type == fcgiprotocol.FCGI_END_REQUEST {
+		rec = hideEndRequestReserved(rec)
+		x.responseDone = true
+	}
+	x.response = x.keep(x.response, rec, e.maxLen())
+	if x.requestDone() && x.responseDone {
+		e.flush(id)
+	}
+}
+
+// close logs what is left once the connection is closed.
+func (e *exchanges) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := make([]int, 0, len(e.current))
+	for id := range e.current {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		e.flush(uint16(id))
+	}
+}
+
+func (e *exchanges) maxLen() int {
+	if e.max > 0 {
+		return e.max
+	}
+	return maxExchangeLen
+}
+
+func (e *exchanges) get(id uint16) *exchange {
+	if e.current == nil {
+		e.current = map[uint16]*exchange{}
+	}
+	x, ok := e.current[id]
+	if !ok {
+		x = &exchange{}
+		e.current[id] = x
+	}
+	return x
+}
+
+func (e *exchanges) flush(id uint16) {
+	x, ok := e.current[id]
+	if !ok {
+		return
+	}
+	delete(e.current, id)
+	if !x.requestDone() || !x.responseDone {
+		e.printf("exchange %d not finished", id)
+	}
+	if x.dropped > 0 {
+		e.printf("exchange %d truncated, %d bytes of records not logged", id, x.dropped)
+	}
+	if len(x.request) > 0 {
+		e.print("request %d read raw %s", id, x.request)
+		d, err := fcgiprotocol.DecodeRequest(x.request)
+		if e.decode {
+			if err != nil {
+				e.printf("cannot decode request %d : %v", id, err)
+			} else {
+				e.print("decoded request %d %s", id, newDecodedRequest(d))
+			}
+		}
+		if err == nil {
+			for _, warning := range x.lengthWarnings(d.Env) {
+				e.printf("protocol warning request %d : %s", id, warning)
+			}
+		}
+	}
+	if len(x.response) > 0 {
+		e.print("response %d read raw %s", id, x.response)
+	}
+}
+
+// lengthWarnings compares the length of the streams which are over to the
+// length declared in the params, a front end may send a wrong
+// CONTENT_LENGTH or none with a chunked body.
+func (x *exchange) lengthWarnings(env fcgiprotocol.Params) []string {
+	warnings := []string{}
+	check := func(name, stream string, got int) {
+		declared, ok := env.Lookup(name)
+		if !ok {
+			if got > 0 {
+				warnings = append(warnings, fmt.Sprintf("%s is not set but %s has %d bytes", name, stream, got))
+			}
+			return
+		}
+		length, err := strconv.Atoi(declared)
+		if err != nil || length < 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %q is not a length, %s has %d bytes", name, declared, stream, got))
+			return
+		}
+		if length != got {
+			warnings = append(warnings, fmt.Sprintf("%s is %d but %s has %d bytes", name, length, stream, got))
+		}
+	}
+	if x.stdinDone {
+		check("CONTENT_LENGTH", "stdin", x.stdinLen)
+	}
+	if x.dataDone && x.filter {
+		check("FCGI_DATA_LENGTH", "data", x.dataLen)
+	}
+	return warnings
+}
+
+// decodedRequest is the fcgiprotocol.Request logged once decoded.
+type decodedRequest struct {
+	ReqId uint16
+	Role  uint16
+	Flags uint8
+	Env   []decodedPair
+	Stdin []byte
+	Data  []byte
+}
+
+func newDecodedRequest(d fcgiprotocol.Request) decodedRequest {
+	env := make([]decodedPair, 0, len(d.Env))
+	for _, pair := range d.Env {
+		env = append(env, decodedPair(pair))
+	}
+	return decodedRequest{ReqId: d.ReqId, Role: d.Role, Flags: d.Flags, Env: env, Stdin: d.Stdin, Data: d.Data}
+}
+
+// decodedPair is a param logged as json. A name or a value which is not
+// valid UTF-8 would get its bytes replaced by U+FFFD, it is logged in
+// base64 as KeyBase64 or ValueBase64 instead.
+type decodedPair fcgiprotocol.Pair
+
+func (p decodedPair) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, field := range []struct{ name, value string }{{"Key", p.Key}, {"Value", p.Value}} {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		var value any = field.value
+		if !utf8.ValidString(field.value) {
+			field.name += "Base64"
+			value = []byte(field.value)
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buf, "%q:%s", field.name, b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// print logs msg with data marshaled as json, args come before it.
+func (e *exchanges) print(msg string, args ...any) {
+	data := args[len(args)-1]
+	b, err := json.Marshal(data)
+	if err != nil {
+		e.printf("cannot marshal %T : %v", data, err)
+		return
+	}
+	e.printf(msg, append(args[:len(args)-1], b)...)
+}
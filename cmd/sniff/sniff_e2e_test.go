@@ -3,13 +3,14 @@ package sniff
 import (
 	"app/fcgi/fcgiclient"
 	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"reflect"
 	"strings"
@@ -17,30 +18,6 @@ import (
 	"time"
 )
 
-func runPhpFpmServer(t *testing.T) (string, func() error) {
-	t.Helper()
-	cwd, _ := os.Getwd()
-	cwd = path.Join(cwd, "../../php-fpm")
-	// binary can be downloaded from https://dl.static-php.dev/static-php-cli/common/
-	cmd := exec.Command("./php-fpm", "-y", path.Join(cwd, "php-fpm.conf"), "-p", cwd)
-	cmd.Dir = cwd
-	err := cmd.Start()
-	if err != nil {
-		t.Fatalf("cannot start php-fpm : %v", err)
-	}
-	time.Sleep(time.Second)
-	return cwd, cmd.Process.Kill
-}
-
-func MustUrl(t *testing.T, rawUrl string) *url.URL {
-	t.Helper()
-	u, err := url.Parse(rawUrl)
-	if err != nil {
-		t.Fatalf("cannot parse url %s : %v", rawUrl, err)
-	}
-	return u
-}
-
 func MustMarshlJson(t *testing.T, data any) string {
 	result, err := json.Marshal(data)
 	if err != nil {
@@ -50,12 +27,9 @@ func MustMarshlJson(t *testing.T, data any) string {
 }
 
 func TestDo(t *testing.T) {
-	dir, closer := runPhpFpmServer(t)
-	defer func() {
-		if err := closer(); err != nil {
-			t.Fatalf("failed to kill process: %v", err)
-		}
-	}()
+	srv := fcgitest.NewServer(fcgitest.EchoHandler)
+	defer srv.Close()
+	dir := fcgitest.DocumentRoot(t)
 
 	tests := map[string]struct {
 		In       fcgiclient.Request
@@ -67,23 +41,23 @@ func TestDo(t *testing.T) {
 			In: fcgiclient.Request{
 				DocumentRoot: dir,
 				Method:       "POST",
-				Url:          MustUrl(t, "/api/auth-tokens?status_code=201"),
-				Body:         `{"login":admin","password":"azertyu"}` + "\n",
+				Url:          fcgitest.MustUrl(t, "/api/auth-tokens?status_code=201"),
+				Body:         strings.NewReader(`{"login":admin","password":"azertyu"}` + "\n"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header: map[string]string{
-					"Content-type": "application/json",
+				Env:          fcgiprotocol.Params{},
+				Header: http.Header{
+					"Content-Type": {"application/json"},
 				},
 			},
 			Expected: fcgiclient.Response{
 				StatusCode: 201,
-				Header: map[string]string{
-					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
-					"X-Request-Uri": "/api/auth-tokens?status_code=201",
-					"Status":        "201 Created",
-					"X-Status-Code": "201",
-					"Status-Code":   "201",
+				Reason:     "Created",
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/api/auth-tokens?status_code=201"},
+					"Status":        {"201 Created"},
+					"X-Status-Code": {"201"},
+					"Status-Code":   {"201"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1>",
@@ -103,36 +77,34 @@ func TestDo(t *testing.T) {
 				Stderr: "",
 			},
 			Logger: strings.Join([]string{
-				"Proxy listening on 127.0.0.1:9001, forwarding to 127.0.0.1:9000",
+				"Proxy listening on 127.0.0.1:9001, forwarding to " + srv.Addr,
 				"handling new TCP client",
 				"connected to server",
-				"request read raw " + MustMarshlJson(t, []fcgiprotocol.Record{
+				"request 1 read raw " + MustMarshlJson(t, []fcgiprotocol.Record{
 					buildRecord(fcgiprotocol.FCGI_BEGIN_REQUEST, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}),
-					pairRecord(t, map[string]string{
-						"CONTENT_LENGTH":    "38",
-						"CONTENT_TYPE":      "application/json",
-						"DOCUMENT_ROOT":     dir,
-						"DOCUMENT_URI":      "/api/auth-tokens",
-						"GATEWAY_INTERFACE": "CGI/1.1",
-						"HTTP_CONTENT_TYPE": "application/json",
-						"QUERY_STRING":      "status_code=201",
-						"REQUEST_METHOD":    "POST",
-						"REQUEST_SCHEME":    "http",
-						"REQUEST_URI":       "/api/auth-tokens?status_code=201",
-						"SCRIPT_FILENAME":   path.Join(dir, "index.php"),
-						"SCRIPT_NAME":       "/api/auth-tokens",
-						"SERVER_PROTOCOL":   "HTTP/1.1",
-						"SERVER_SOFTWARE":   "go / fcgiclient ",
+					pairRecord(t, fcgiprotocol.Params{
+						{Key: "GATEWAY_INTERFACE", Value: "CGI/1.1"},
+						{Key: "REDIRECT_STATUS", Value: "200"},
+						{Key: "REQUEST_SCHEME", Value: "http"},
+						{Key: "SERVER_PROTOCOL", Value: "HTTP/1.1"},
+						{Key: "CONTENT_LENGTH", Value: "38"},
+						{Key: "DOCUMENT_URI", Value: "/api/auth-tokens"},
+						{Key: "REQUEST_METHOD", Value: "POST"},
+						{Key: "SCRIPT_FILENAME", Value: path.Join(dir, "index.php")},
+						{Key: "SCRIPT_NAME", Value: "/index.php"},
+						{Key: "SERVER_SOFTWARE", Value: "go / fcgiclient "},
+						{Key: "DOCUMENT_ROOT", Value: dir},
+						{Key: "QUERY_STRING", Value: "status_code=201"},
+						{Key: "REQUEST_URI", Value: "/api/auth-tokens?status_code=201"},
+						{Key: "CONTENT_TYPE", Value: "application/json"},
 					}),
 					buildRecord(fcgiprotocol.FCGI_PARAMS, []byte{}),
 					buildRecord(fcgiprotocol.FCGI_STDIN, []byte(`{"login":admin","password":"azertyu"}`+"\n")),
+					buildRecord(fcgiprotocol.FCGI_STDIN, []byte{}),
 				}),
-				"writing back request",
-				"finish writing to server, waiting for response",
-				"response read raw " + MustMarshlJson(t, []fcgiprotocol.Record{
+				"response 1 read raw " + MustMarshlJson(t, []fcgiprotocol.Record{
 					buildRecord(fcgiprotocol.FCGI_STDOUT, []byte(strings.Join([]string{
 						"Status: 201 Created",
-						"X-Powered-By: PHP/8.3.7",
 						"Status-Code:201",
 						"X-Status-Code: 201",
 						"X-Request-Uri: /api/auth-tokens?status_code=201",
@@ -154,9 +126,10 @@ func TestDo(t *testing.T) {
 						`{"login":admin","password":"azertyu"}`,
 						"</pre>",
 					}, "\n"))),
+					buildRecord(fcgiprotocol.FCGI_STDOUT, []byte{}),
 					buildRecord(fcgiprotocol.FCGI_END_REQUEST, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}),
 				}),
-				"writing back response",
+				"context done, stopping listener accept loop",
 				"",
 			}, "\n"),
 		},
@@ -165,21 +138,25 @@ func TestDo(t *testing.T) {
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			done := make(chan struct{})
-			defer close(done)
+			stopped := make(chan error)
 			buf := &bytes.Buffer{}
 			l := log.New(buf, "", 0)
 			printf := func(msg string, args ...interface{}) {
 				l.Printf(msg, args...)
-				t.Logf(msg, args...)
 			}
-			go buildServerAndRun(done, printf, "127.0.0.1:9001", "127.0.0.1:9000", false)
+			go func() {
+				stopped <- buildServerAndRun(done, printf, "127.0.0.1:9001", srv.Addr, false)
+			}()
 			time.Sleep(time.Second)
 			conn, err := net.Dial("tcp", "127.0.0.1:9001")
 			if err != nil {
 				t.Fatalf("cannot dial php server : %v", err)
 			}
-			defer conn.Close()
 			result, err := fcgiclient.Do(conn, tt.In)
+			conn.Close()
+			// the exchange is logged by the time sniff is stopped
+			close(done)
+			<-stopped
 			testError(t, err, tt.Error)
 			if !reflect.DeepEqual(tt.Expected, result) {
 				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, result)
@@ -210,7 +187,7 @@ func testError(t *testing.T, got error, want string) {
 	}
 }
 
-func pairRecord(t *testing.T, pairs map[string]string) fcgiprotocol.Record {
+func pairRecord(t *testing.T, pairs fcgiprotocol.Params) fcgiprotocol.Record {
 	t.Helper()
 	buf := &bytes.Buffer{}
 	err := fcgiprotocol.BuildPair(buf, pairs)
@@ -230,3 +207,169 @@ func buildRecord(recType uint8, data []byte) fcgiprotocol.Record {
 	rec.Buf = data
 	return rec
 }
+
+func TestUnixSockets(t *testing.T) {
+	srv := fcgitest.NewUnstartedServer(fcgitest.EchoHandler)
+	srv.Network = "unix"
+	srv.Start()
+	defer srv.Close()
+	dir := fcgitest.DocumentRoot(t)
+	socket := path.Join(t.TempDir(), "sniff.sock")
+
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- buildServerAndRun(done, t.Logf, "unix:"+socket, "unix:"+srv.Addr, false)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot dial sniff socket : %v", err)
+	}
+	// the connection is kept open, like nginx keeps it alive
+	defer conn.Close()
+	result, err := fcgiclient.Do(conn, fcgiclient.Request{
+		DocumentRoot: dir,
+		Method:       "GET",
+		Url:          fcgitest.MustUrl(t, "/hello"),
+		Index:        "index.php",
+	})
+	if err != nil {
+		t.Fatalf("failed running request : %v", err)
+	}
+	if result.StatusCode != 200 || !strings.Contains(result.Stdout, "<p>/hello</p>") {
+		t.Fatalf("unexpected response %#v", result)
+	}
+
+	close(done)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("sniff stopped with error : %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("sniff did not stop with an idle connection open")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("sniff socket should be removed on shutdown got %v", err)
+	}
+}
+
+func TestKeepConn(t *testing.T) {
+	srv := fcgitest.NewServer(fcgitest.EchoHandler)
+	defer srv.Close()
+	dir := fcgitest.DocumentRoot(t)
+
+	done := make(chan struct{})
+	stopped := make(chan error)
+	buf := &bytes.Buffer{}
+	l := log.New(buf, "", 0)
+	go func() {
+		stopped <- buildServerAndRun(done, l.Printf, "127.0.0.1:9002", srv.Addr, true)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	c := &fcgiclient.Client{Dial: fcgiclient.DialAddr("127.0.0.1:9002"), MaxIdleConns: 1}
+	for _, p := range []string{"/first", "/second"} {
+		result, err := c.Do(fcgiclient.Request{
+			DocumentRoot: dir,
+			Method:       "GET",
+			Url:          fcgitest.MustUrl(t, p),
+			Index:        "index.php",
+		})
+		if err != nil {
+			t.Fatalf("failed running request %s : %v", p, err)
+		}
+		if !strings.Contains(result.Stdout, "<p>"+p+"</p>") {
+			t.Fatalf("unexpected response %#v", result)
+		}
+	}
+	c.CloseIdleConnections()
+	close(done)
+	<-stopped
+
+	logged := buf.String()
+	if n := strings.Count(logged, "handling new TCP client"); n != 1 {
+		t.Fatalf("want both requests on one connection got %d connections\n%s", n, logged)
+	}
+	if n := strings.Count(logged, "decoded request 1 "); n != 2 {
+		t.Fatalf("want 2 decoded requests got %d\n%s", n, logged)
+	}
+	if n := strings.Count(logged, "response 1 read raw "); n != 2 {
+		t.Fatalf("want 2 responses got %d\n%s", n, logged)
+	}
+	if strings.Contains(logged, "not finished") {
+		t.Fatalf("want every exchange finished\n%s", logged)
+	}
+}
+
+func TestMultiplexed(t *testing.T) {
+	// both requests are answered only once both arrived, so they are
+	// interleaved on the connection
+	started := make(chan struct{}, 2)
+	srv := fcgitest.NewUnstartedServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		started <- struct{}{}
+		for len(started) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		fmt.Fprintf(w, "Content-type: text/plain\r\n\r\n%s", r.Env["REQUEST_URI"])
+	})
+	srv.Multiplex = true
+	srv.Start()
+	defer srv.Close()
+
+	done := make(chan struct{})
+	stopped := make(chan error)
+	buf := &bytes.Buffer{}
+	l := log.New(buf, "", 0)
+	go func() {
+		stopped <- buildServerAndRun(done, l.Printf, "127.0.0.1:9003", srv.Addr, true)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	rwc, err := net.Dial("tcp", "127.0.0.1:9003")
+	if err != nil {
+		t.Fatalf("cannot dial sniff : %v", err)
+	}
+	values, err := fcgiprotocol.GetValues(rwc, fcgiprotocol.FCGI_MPXS_CONNS)
+	if err != nil || values[fcgiprotocol.FCGI_MPXS_CONNS] != "1" {
+		t.Fatalf("want multiplexing reported got %v %v", values, err)
+	}
+	conn := fcgiprotocol.NewConn(rwc)
+	errs := make(chan error, 2)
+	for _, uri := range []string{"/first", "/second"} {
+		go func() {
+			raw, err := conn.Do(fcgiprotocol.Params{{Key: "REQUEST_URI", Value: uri}}, nil)
+			if err == nil && !strings.HasSuffix(string(raw.Stdout), uri) {
+				err = fmt.Errorf("unexpected response %q", raw.Stdout)
+			}
+			errs <- err
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed running request : %v", err)
+		}
+	}
+	conn.Close()
+	close(done)
+	<-stopped
+
+	logged := buf.String()
+	for _, want := range []string{
+		"management request read raw ",
+		"management response read raw ",
+		`decoded request 1 {"ReqId":1`,
+		`decoded request 2 {"ReqId":2`,
+		"response 1 read raw ",
+		"response 2 read raw ",
+	} {
+		if strings.Count(logged, want) != 1 {
+			t.Fatalf("want one %q in log got\n%s", want, logged)
+		}
+	}
+	if strings.Contains(logged, "not finished") || strings.Contains(logged, "cannot decode") {
+		t.Fatalf("want every exchange decoded and finished\n%s", logged)
+	}
+}
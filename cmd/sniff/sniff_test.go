@@ -3,53 +3,331 @@ package sniff
 import (
 	"app/fcgi/fcgiprotocol"
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
-func TestReadFullRequest(t *testing.T) {
-	var buf bytes.Buffer
-	err := fcgiprotocol.WriteRequest(
-		fcgiprotocol.RawRecordWriter(&buf),
-		0,
-		map[string]string{"CONTENT_LENGTH": "4", "test": "test"},
-		"body",
+func TestExchangesMultiplexed(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := log.New(buf, "", 0)
+	e := &exchanges{printf: l.Printf}
+	record := func(recType uint8, reqId uint16, content []byte) fcgiprotocol.Record {
+		return fcgiprotocol.Record{Header: fcgiprotocol.NewHeader(recType, reqId, len(content)), Buf: content}
+	}
+	e.fromClient(record(fcgiprotocol.FCGI_GET_VALUES, 0, []byte{}))
+	e.fromServer(record(fcgiprotocol.FCGI_UNKNOWN_TYPE, 0, []byte{fcgiprotocol.FCGI_GET_VALUES, 0, 0, 0, 0, 0, 0, 0}))
+	for _, id := range []uint16{1, 2} {
+		e.fromClient(record(fcgiprotocol.FCGI_BEGIN_REQUEST, id, []byte{0, 1, 1, 0, 0, 0, 0, 0}))
+	}
+	for _, id := range []uint16{1, 2} {
+		e.fromClient(record(fcgiprotocol.FCGI_PARAMS, id, []byte{}))
+		e.fromClient(record(fcgiprotocol.FCGI_STDIN, id, []byte{}))
+	}
+	// the responses are interleaved record by record and end in reverse
+	for _, id := range []uint16{1, 2} {
+		e.fromServer(record(fcgiprotocol.FCGI_STDOUT, id, []byte("out "+strconv.Itoa(int(id)))))
+	}
+	for _, id := range []uint16{2, 1} {
+		e.fromServer(record(fcgiprotocol.FCGI_STDOUT, id, []byte{}))
+		e.fromServer(record(fcgiprotocol.FCGI_END_REQUEST, id, []byte{0, 0, 0, 0, 0, 1, 2, 3}))
+	}
+	e.fromClient(record(fcgiprotocol.FCGI_BEGIN_REQUEST, 3, []byte{0, 1, 1, 0, 0, 0, 0, 0}))
+	e.close()
+
+	exchange := func(id uint16) []string {
+		return []string{
+			"request " + strconv.Itoa(int(id)) + " read raw " + mustJson(t, []fcgiprotocol.Record{
+				record(fcgiprotocol.FCGI_BEGIN_REQUEST, id, []byte{0, 1, 1, 0, 0, 0, 0, 0}),
+				record(fcgiprotocol.FCGI_PARAMS, id, []byte{}),
+				record(fcgiprotocol.FCGI_STDIN, id, []byte{}),
+			}),
+			"response " + strconv.Itoa(int(id)) + " read raw " + mustJson(t, []fcgiprotocol.Record{
+				record(fcgiprotocol.FCGI_STDOUT, id, []byte("out "+strconv.Itoa(int(id)))),
+				record(fcgiprotocol.FCGI_STDOUT, id, []byte{}),
+				record(fcgiprotocol.FCGI_END_REQUEST, id, []byte{0, 0, 0, 0, 0, 0, 0, 0}),
+			}),
+		}
+	}
+	expected := []string{
+		"management request read raw " + mustJson(t, []fcgiprotocol.Record{record(fcgiprotocol.FCGI_GET_VALUES, 0, []byte{})}),
+		"management response read raw " + mustJson(t, []fcgiprotocol.Record{record(fcgiprotocol.FCGI_UNKNOWN_TYPE, 0, []byte{fcgiprotocol.FCGI_GET_VALUES, 0, 0, 0, 0, 0, 0, 0})}),
+	}
+	expected = append(expected, exchange(2)...)
+	expected = append(expected, exchange(1)...)
+	expected = append(expected,
+		"exchange 3 not finished",
+		"request 3 read raw "+mustJson(t, []fcgiprotocol.Record{record(fcgiprotocol.FCGI_BEGIN_REQUEST, 3, []byte{0, 1, 1, 0, 0, 0, 0, 0})}),
+		"",
 	)
+	if buf.String() != strings.Join(expected, "\n") {
+		t.Fatalf("want \n%s\ngot \n%s\n", strings.Join(expected, "\n"), buf.String())
+	}
+}
+
+func mustJson(t *testing.T, data any) string {
+	t.Helper()
+	b, err := json.Marshal(data)
 	if err != nil {
-		t.Fatalf("WriteRequest failed: %v", err)
+		t.Fatalf("cannot marshal json %#v : %v", data, err)
 	}
-	printf := func(msg string, args ...interface{}) {
-		t.Logf(msg, args...)
+	return string(b)
+}
+
+// sniffedRequest is a request written by WriteRoleRequest, Cut drops its
+// last record.
+type sniffedRequest struct {
+	Role uint8
+	Env  fcgiprotocol.Params
+	Body string
+	Data string
+	Cut  bool
+}
+
+func (r sniffedRequest) records(t *testing.T, id uint16) []fcgiprotocol.Record {
+	t.Helper()
+	records := []fcgiprotocol.Record{}
+	w := func(recType uint8, reqId uint16, content []byte) error {
+		records = append(records, fcgiprotocol.Record{Header: fcgiprotocol.NewHeader(recType, reqId, len(content)), Buf: content})
+		return nil
 	}
-	records, err := ReadFullRequest(printf)(&buf)
+	err := fcgiprotocol.WriteRoleRequest(w, id, r.Role, fcgiprotocol.FCGI_KEEP_CONN, r.Env, strings.NewReader(r.Body), strings.NewReader(r.Data))
 	if err != nil {
-		t.Fatalf("ReadFullRequest failed: %v", err)
+		t.Fatalf("WriteRoleRequest failed: %v", err)
 	}
+	if r.Cut {
+		records = records[:len(records)-1]
+	}
+	return records
+}
 
-	expected := []fcgiprotocol.Record{
-		{
-			Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_BEGIN_REQUEST, 0, 8),
-			Buf:    []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+func TestExchangesFraming(t *testing.T) {
+	responder := func(env fcgiprotocol.Params, body string) sniffedRequest {
+		return sniffedRequest{Role: fcgiprotocol.FCGI_RESPONDER, Env: env, Body: body}
+	}
+	tests := map[string]struct {
+		Requests [2]sniffedRequest
+		Expected []string
+	}{
+		"matching lengths": {
+			Requests: [2]sniffedRequest{
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "4"}}, "body"),
+				responder(fcgiprotocol.Params{}, ""),
+			},
+			Expected: []string{},
+		},
+		"content length mismatch": {
+			Requests: [2]sniffedRequest{
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "10"}}, "body"),
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "4"}}, "body"),
+			},
+			Expected: []string{
+				"protocol warning request 1 : CONTENT_LENGTH is 10 but stdin has 4 bytes",
+			},
+		},
+		"missing content length": {
+			Requests: [2]sniffedRequest{
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "4"}}, "body"),
+				responder(fcgiprotocol.Params{}, "chunked body"),
+			},
+			Expected: []string{
+				"protocol warning request 2 : CONTENT_LENGTH is not set but stdin has 12 bytes",
+			},
+		},
+		"invalid content length": {
+			Requests: [2]sniffedRequest{
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "abc"}}, "body"),
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "-1"}}, ""),
+			},
+			Expected: []string{
+				`protocol warning request 1 : CONTENT_LENGTH "abc" is not a length, stdin has 4 bytes`,
+				`protocol warning request 2 : CONTENT_LENGTH "-1" is not a length, stdin has 0 bytes`,
+			},
+		},
+		"filter data length": {
+			Requests: [2]sniffedRequest{
+				{
+					Role: fcgiprotocol.FCGI_FILTER,
+					Env:  fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "4"}, {Key: "FCGI_DATA_LENGTH", Value: "3"}},
+					Body: "body",
+					Data: "data",
+				},
+				{
+					Role: fcgiprotocol.FCGI_FILTER,
+					Env:  fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "4"}, {Key: "FCGI_DATA_LENGTH", Value: "4"}},
+					Body: "body",
+					Data: "data",
+				},
+			},
+			Expected: []string{
+				"protocol warning request 1 : FCGI_DATA_LENGTH is 3 but data has 4 bytes",
+			},
+		},
+		"missing stdin terminator": {
+			Requests: [2]sniffedRequest{
+				responder(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "10"}}, "body"),
+				{Role: fcgiprotocol.FCGI_RESPONDER, Env: fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "10"}}, Body: "body", Cut: true},
+			},
+			Expected: []string{
+				"protocol warning request 1 : CONTENT_LENGTH is 10 but stdin has 4 bytes",
+				"exchange 2 not finished",
+			},
 		},
-		{
-			Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_PARAMS, 0, 27),
-			Buf: fcgiprotocol.MustBuildPairWithPadding(
-				map[string]string{
-					"CONTENT_LENGTH": "4",
-					"test":           "test"},
-				5,
-			),
+		"missing data terminator": {
+			Requests: [2]sniffedRequest{
+				{Role: fcgiprotocol.FCGI_FILTER, Env: fcgiprotocol.Params{{Key: "FCGI_DATA_LENGTH", Value: "4"}}, Data: "data", Cut: true},
+				responder(fcgiprotocol.Params{}, ""),
+			},
+			Expected: []string{
+				"exchange 1 not finished",
+			},
 		},
-		{
-			Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_PARAMS, 0, 0),
-			Buf:    []byte{},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, logged := recordLog(false)
+			// the records of both requests are interleaved one by one
+			first, second := tt.Requests[0].records(t, 1), tt.Requests[1].records(t, 2)
+			for i := 0; i < len(first) || i < len(second); i++ {
+				if i < len(first) {
+					e.fromClient(first[i])
+				}
+				if i < len(second) {
+					e.fromClient(second[i])
+				}
+			}
+			for _, id := range []uint16{1, 2} {
+				e.fromServer(fcgiprotocol.Record{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_END_REQUEST, id, 8), Buf: make([]byte, 8)})
+			}
+			e.close()
+
+			got := []string{}
+			for _, line := range *logged {
+				if strings.HasPrefix(line, "protocol warning") || strings.HasPrefix(line, "exchange") {
+					got = append(got, line)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.Expected) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, got)
+			}
+		})
+	}
+}
+
+// recordLog returns exchanges logging to the returned slice.
+func recordLog(decode bool) (*exchanges, *[]string) {
+	logged := &[]string{}
+	return &exchanges{decode: decode, printf: func(msg string, args ...interface{}) {
+		*logged = append(*logged, fmt.Sprintf(msg, args...))
+	}}, logged
+}
+
+func TestExchangesTruncated(t *testing.T) {
+	e, logged := recordLog(true)
+	e.max = 64
+	record := func(recType uint8, content []byte) fcgiprotocol.Record {
+		return fcgiprotocol.Record{Header: fcgiprotocol.NewHeader(recType, 1, len(content)), Buf: content}
+	}
+	e.fromClient(record(fcgiprotocol.FCGI_BEGIN_REQUEST, []byte{0, 1, 0, 0, 0, 0, 0, 0}))
+	e.fromClient(record(fcgiprotocol.FCGI_PARAMS, fcgiprotocol.MustBuildPairWithPadding(fcgiprotocol.Params{{Key: "CONTENT_LENGTH", Value: "96"}}, 0)))
+	e.fromClient(record(fcgiprotocol.FCGI_PARAMS, []byte{}))
+	for range 3 {
+		e.fromClient(record(fcgiprotocol.FCGI_STDIN, bytes.Repeat([]byte{'a'}, 32)))
+	}
+	e.fromClient(record(fcgiprotocol.FCGI_STDIN, []byte{}))
+	e.fromServer(record(fcgiprotocol.FCGI_END_REQUEST, make([]byte, 8)))
+
+	want := []string{
+		"exchange 1 truncated, 136 bytes of records not logged",
+		"request 1 read raw ",
+		`decoded request 1 {"ReqId":1,"Role":1,"Flags":0,"Env":[{"Key":"CONTENT_LENGTH","Value":"96"}],"Stdin":null`,
+	}
+	if len(*logged) != 3 {
+		t.Fatalf("want the request logged without a warning and the response dropped got \n%#v\n", *logged)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix((*logged)[i], prefix) {
+			t.Fatalf("want %q got \n%#v\n", prefix, *logged)
+		}
+	}
+}
+
+func TestExchangesDecodedParams(t *testing.T) {
+	e, logged := recordLog(true)
+	request := sniffedRequest{
+		Role: fcgiprotocol.FCGI_RESPONDER,
+		Env:  fcgiprotocol.Params{{Key: "B", Value: "caf\xe9"}, {Key: "A", Value: "1"}, {Key: "B", Value: "café"}},
+	}
+	for _, rec := range request.records(t, 1) {
+		e.fromClient(rec)
+	}
+	e.fromServer(fcgiprotocol.Record{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_END_REQUEST, 1, 8), Buf: make([]byte, 8)})
+
+	want := `decoded request 1 {"ReqId":1,"Role":1,"Flags":1,"Env":[{"Key":"B","ValueBase64":"Y2Fm6Q=="},{"Key":"A","Value":"1"},{"Key":"B","Value":"café"}],"Stdin":null,"Data":null}`
+	if len(*logged) != 3 || (*logged)[1] != want {
+		t.Fatalf("want \n%s\ngot \n%#v\n", want, *logged)
+	}
+}
+
+func TestExchangesBadInput(t *testing.T) {
+	tests := map[string]struct {
+		Request  []fcgiprotocol.Record
+		Response []fcgiprotocol.Record
+		Expected []string
+	}{
+		"truncated pair": {
+			Request: []fcgiprotocol.Record{
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_BEGIN_REQUEST, 1, 8), Buf: []byte{0, 1, 0, 0, 0, 0, 0, 0}},
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_PARAMS, 1, 2), Buf: []byte{0x80, 0xff}},
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_STDIN, 1, 0), Buf: []byte{}},
+			},
+			Response: []fcgiprotocol.Record{
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_END_REQUEST, 1, 8), Buf: []byte{0, 0, 0, 0, 0, 9, 9, 9}},
+			},
+			Expected: []string{
+				"request 1 read raw ",
+				"cannot decode request 1 : cannot decode param fcgi: truncated name-value pair",
+				`response 1 read raw [{"Header":{"Version":1,"Type":3,"Id":1,"ContentLength":8,"PaddingLength":0,"Reserved":0},"Buf":"AAAAAAAAAAA="}]`,
+			},
 		},
-		{
-			Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_STDIN, 0, 4),
-			Buf:    []byte{'b', 'o', 'd', 'y', 0, 0, 0, 0},
+		"short end request": {
+			Request: []fcgiprotocol.Record{
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_BEGIN_REQUEST, 1, 8), Buf: []byte{0, 1, 0, 0, 0, 0, 0, 0}},
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_STDIN, 1, 0), Buf: []byte{}},
+			},
+			Response: []fcgiprotocol.Record{
+				{Header: fcgiprotocol.NewHeader(fcgiprotocol.FCGI_END_REQUEST, 1, 2), Buf: []byte{7, 7}},
+			},
+			Expected: []string{
+				"request 1 read raw ",
+				"decoded request 1 ",
+				`response 1 read raw [{"Header":{"Version":1,"Type":3,"Id":1,"ContentLength":2,"PaddingLength":6,"Reserved":0},"Buf":"Bwc="}]`,
+			},
 		},
 	}
-	if !reflect.DeepEqual(records, expected) {
-		t.Fatalf("got \n%#v\n, exp \n%#v\n", records, expected)
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, logged := recordLog(true)
+			for _, rec := range tt.Request {
+				e.fromClient(rec)
+			}
+			for _, rec := range tt.Response {
+				e.fromServer(rec)
+			}
+			if len(*logged) != len(tt.Expected) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, *logged)
+			}
+			for i, prefix := range tt.Expected {
+				if !strings.HasPrefix((*logged)[i], prefix) {
+					t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, *logged)
+				}
+			}
+		})
 	}
 }
@@ -1,6 +1,7 @@
 package sniff
 
 import (
+	"app/fcgi/fcgiclient"
 	"app/fcgi/fcgiprotocol"
 	"app/pkg/server"
 	"context"
@@ -9,26 +10,21 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 )
 
 const Action = "sniff"
 
-type FastCGITrame struct {
-	Requests  string `json:"requests"`
-	Responses string `json:"responses"`
-}
-
 func Run(args []string) error {
 	phpFpmAddr := "127.0.0.1:9000"
 	proxyAddr := "127.0.0.1:9001"
 	dontDecodeRequest := false
 	help := false
 	fs := flag.NewFlagSet(Action, flag.ContinueOnError)
-	fs.StringVar(&phpFpmAddr, "forward-to", phpFpmAddr, "forward to fpm server at")
-	fs.StringVar(&proxyAddr, "listen", proxyAddr, "proxy fastcgi listen to")
+	fs.StringVar(&phpFpmAddr, "forward-to", phpFpmAddr, "forward to fpm server at, unix:/path/to.sock for a unix socket")
+	fs.StringVar(&proxyAddr, "listen", proxyAddr, "proxy fastcgi listen to, unix:/path/to.sock for a unix socket")
 	fs.BoolVar(&dontDecodeRequest, "no-decode", dontDecodeRequest, "stop decoding request")
 	fs.BoolVar(&help, "help", help, "print cmd help")
 	err := fs.Parse(args)
@@ -40,8 +36,11 @@ func Run(args []string) error {
 		return nil
 	}
 	l := log.New(os.Stdout, "", log.LstdFlags)
+	// stopping on a signal closes the listener which removes its socket
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	return buildServerAndRun(
-		context.Background().Done(),
+		ctx.Done(),
 		func(msg string, args ...interface{}) { l.Printf(msg, args...) },
 		proxyAddr,
 		phpFpmAddr,
@@ -52,126 +51,68 @@ func Run(args []string) error {
 type Printf func(msg string, args ...interface{})
 
 func buildServerAndRun(done <-chan struct{}, printf Printf, proxyAddr, phpFpmAddr string, decode bool) error {
-	listener, err := net.Listen("tcp", proxyAddr)
+	listener, err := server.Listen(fcgiclient.ParseAddr(proxyAddr))
 	if err != nil {
 		return fmt.Errorf("Error creating listener: %w", err)
 	}
 	defer listener.Close()
 	printf("Proxy listening on %s, forwarding to %s", proxyAddr, phpFpmAddr)
-	clientToServer := server.Pipe[[]fcgiprotocol.Record]{
-		Reader: ReadFullRequest(printf),
-		Writer: writeRecords,
-	}
-	if decode {
-		clientToServer.Decoder = func(data []fcgiprotocol.Record) (interface{}, error) {
-			d, err := fcgiprotocol.DecodeRequest(data)
-			return d, err
-		}
-	}
-	serverToClient := server.Pipe[[]fcgiprotocol.Record]{
-		Reader:  ReadFullResponse,
-		Writer:  writeRecords,
-		Decoder: nil,
-	}
+	dial := fcgiclient.DialAddr(phpFpmAddr)
 
 	server.Run(
 		done,
 		listener,
-		server.Proxy[[]fcgiprotocol.Record](
-			func() (io.ReadWriteCloser, error) {
-				return net.Dial("tcp", phpFpmAddr)
-			},
-			clientToServer,
-			serverToClient,
-			printf,
-		),
+		func(clientConn io.ReadWriter) error {
+			// records are copied as they come so requests keep flowing on
+			// a kept connection, each exchange is logged once it is over
+			exchanges := &exchanges{printf: printf, decode: decode}
+			defer exchanges.close()
+			return server.Duplex[fcgiprotocol.Record](
+				func() (io.ReadWriteCloser, error) {
+					return dial()
+				},
+				server.Stream[fcgiprotocol.Record]{
+					Reader:  readRecord,
+					Writer:  writeRecord,
+					Observe: exchanges.fromClient,
+				},
+				server.Stream[fcgiprotocol.Record]{
+					Reader:  readRecord,
+					Writer:  writeRecord,
+					Observe: exchanges.fromServer,
+				},
+				printf,
+			)(clientConn)
+		},
 		printf,
 	)
 	return nil
 }
 
-func ReadFullRequest(printf Printf) func(r io.Reader) ([]fcgiprotocol.Record, error) {
-	return func(r io.Reader) ([]fcgiprotocol.Record, error) {
-		reccords := make([]fcgiprotocol.Record, 0, 3)
-
-		for {
-			rec := fcgiprotocol.Record{}
-			err := rec.Read(r)
-			if err != nil && err != io.EOF {
-				return nil, err
-			}
-			reccords = append(reccords, rec)
-			if err == io.EOF {
-				break
-			}
-			if rec.Header.Type == fcgiprotocol.FCGI_PARAMS && len(rec.Content()) == 0 {
-				break
-			}
-		}
-
-		req, err := fcgiprotocol.DecodeRequest(reccords)
-		if err != nil {
-			return reccords, fmt.Errorf("cannot decode request : %w", err)
-		}
-		lengthStr, _ := req.Env["CONTENT_LENGTH"]
-		length, _ := strconv.Atoi(lengthStr)
-		read := 0
-
-		for read < length {
-			rec := fcgiprotocol.Record{}
-			err := rec.Read(r)
-			if err != nil {
-				return nil, err
-			}
-			reccords = append(reccords, rec)
-
-			if rec.Header.Type == fcgiprotocol.FCGI_STDIN {
-				read += len(rec.Content())
-			}
-		}
-
-		return reccords, nil
-	}
+func readRecord(r io.Reader) (fcgiprotocol.Record, error) {
+	rec := fcgiprotocol.Record{}
+	err := rec.Read(r)
+	return rec, err
 }
 
-func writeRecords(w io.Writer, recs []fcgiprotocol.Record) error {
-	for _, r := range recs {
-		if err := binary.Write(w, binary.BigEndian, r.Header); err != nil {
-			return fmt.Errorf("Error sending request header to server: %w", err)
-		}
-		if _, err := w.Write(r.Buf); err != nil {
-			return fmt.Errorf("Error sending request content to server: %w", err)
-		}
+func writeRecord(w io.Writer, rec fcgiprotocol.Record) error {
+	if err := binary.Write(w, binary.BigEndian, rec.Header); err != nil {
+		return fmt.Errorf("Error sending record header: %w", err)
+	}
+	if _, err := w.Write(rec.Buf); err != nil {
+		return fmt.Errorf("Error sending record content: %w", err)
 	}
 	return nil
 }
 
-func ReadFullResponse(r io.Reader) ([]fcgiprotocol.Record, error) {
-	reccords := make([]fcgiprotocol.Record, 0, 3)
-
-	// recive untill EOF or FCGI_END_REQUEST
-	for {
-		rec := fcgiprotocol.Record{}
-		err := rec.Read(r)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		reccords = append(reccords, rec)
-		if err == io.EOF {
-			break
-		}
-		if rec.Header.Type == fcgiprotocol.FCGI_END_REQUEST {
-			hideAllEndRequestBytesButStatusCode(reccords)
-			break
-		}
+// hideEndRequestReserved returns a copy of an FCGI_END_REQUEST record
+// showing only the statuses, its reserved bytes are whatever the
+// application left in memory.
+func hideEndRequestReserved(rec fcgiprotocol.Record) fcgiprotocol.Record {
+	if len(rec.Buf) < 5 {
+		return rec
 	}
-
-	return reccords, nil
-}
-
-func hideAllEndRequestBytesButStatusCode(reccords []fcgiprotocol.Record) {
-	rec := reccords[len(reccords)-1]
-	reccords[len(reccords)-1].Buf = []byte{
+	rec.Buf = []byte{
 		rec.Buf[0],
 		rec.Buf[1],
 		rec.Buf[2],
@@ -179,4 +120,5 @@ func hideAllEndRequestBytesButStatusCode(reccords []fcgiprotocol.Record) {
 		rec.Buf[4],
 		0, 0, 0,
 	}
+	return rec
 }
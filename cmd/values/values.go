@@ -0,0 +1,49 @@
+package values
+
+import (
+	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
+	"flag"
+	"fmt"
+)
+
+const Action = "values"
+
+func Run(args []string) error {
+	host := "127.0.0.1:9000"
+	help := false
+	fs := flag.NewFlagSet(Action, flag.ContinueOnError)
+	fs.StringVar(&host, "host", host, "php-fmp hostname, unix:/path/to.sock for a unix socket")
+	fs.BoolVar(&help, "help", help, "print cmd help")
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("cannot parse argument : %w", err)
+	}
+	if help {
+		fs.PrintDefaults()
+		return nil
+	}
+
+	conn, err := fcgiclient.DialAddr(host)()
+	if err != nil {
+		return fmt.Errorf("cannot dial php server : %w", err)
+	}
+	defer conn.Close()
+
+	v, err := fcgiclient.GetValues(conn)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{
+		fcgiprotocol.FCGI_MAX_CONNS,
+		fcgiprotocol.FCGI_MAX_REQS,
+		fcgiprotocol.FCGI_MPXS_CONNS,
+	} {
+		value, ok := v.Raw[name]
+		if !ok {
+			value = "not reported"
+		}
+		fmt.Printf("%s: %s\n", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package fcgiclient
+
+import (
+	"net"
+	"strings"
+)
+
+// ParseAddr splits an address given on the command line into the network
+// and the address to dial: unix:/run/php/php-fpm.sock and
+// tcp:127.0.0.1:9000 name their network, an absolute path is a unix
+// socket and anything else is a tcp address.
+func ParseAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	if hostport, ok := strings.CutPrefix(addr, "tcp:"); ok {
+		return "tcp", hostport
+	}
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// DialAddr dials addr as described by ParseAddr.
+func DialAddr(addr string) DialFunc {
+	network, address := ParseAddr(addr)
+	return func() (net.Conn, error) {
+		return net.Dial(network, address)
+	}
+}
@@ -0,0 +1,48 @@
+package fcgiclient
+
+import (
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := map[string]struct {
+		In      string
+		Network string
+		Address string
+	}{
+		"host and port": {
+			In:      "127.0.0.1:9000",
+			Network: "tcp",
+			Address: "127.0.0.1:9000",
+		},
+		"tcp prefix": {
+			In:      "tcp:localhost:9000",
+			Network: "tcp",
+			Address: "localhost:9000",
+		},
+		"unix prefix": {
+			In:      "unix:/run/php/php-fpm.sock",
+			Network: "unix",
+			Address: "/run/php/php-fpm.sock",
+		},
+		"relative unix socket": {
+			In:      "unix:php-fpm.sock",
+			Network: "unix",
+			Address: "php-fpm.sock",
+		},
+		"absolute path": {
+			In:      "/run/php/php-fpm.sock",
+			Network: "unix",
+			Address: "/run/php/php-fpm.sock",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			network, address := ParseAddr(tt.In)
+			if network != tt.Network || address != tt.Address {
+				t.Fatalf("want %s %s got %s %s", tt.Network, tt.Address, network, address)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// variablePrefix marks the headers of an authorizer response which are
+// variables for the request it allowed.
+const variablePrefix = "Variable-"
+
+// Authorization is the answer of an FCGI_AUTHORIZER application.
+type Authorization struct {
+	// Allowed is true when the authorizer answered 200.
+	Allowed bool
+	// Variables are the Variable-* headers of an allowed request, named
+	// after what follows the prefix in upper case with '-' as '_', so
+	// Variable-Remote-User is REMOTE_USER. They are meant for the Env of
+	// the request sent to the responder. When the authorizer sets
+	// REMOTE_USER without AUTH_TYPE, AUTH_TYPE is the scheme of the
+	// Authorization header it accepted.
+	Variables map[string]string
+	// Response is the answer of a denied request, to send to the client
+	// as it is. Its Body must be closed.
+	Response *StreamResponse
+}
+
+// Authorize sends req as an FCGI_AUTHORIZER request on rwc.
+func Authorize(ctx context.Context, rwc io.ReadWriteCloser, req Request) (Authorization, error) {
+	req.Role = fcgiprotocol.FCGI_AUTHORIZER
+	sr, err := Stream(ctx, rwc, req)
+	if err != nil {
+		return Authorization{}, err
+	}
+	return authorization(sr, req.Header)
+}
+
+// Authorize sends req as an FCGI_AUTHORIZER request.
+func (c *Client) Authorize(ctx context.Context, req Request) (Authorization, error) {
+	req.Role = fcgiprotocol.FCGI_AUTHORIZER
+	sr, err := c.Stream(ctx, req)
+	if err != nil {
+		return Authorization{}, err
+	}
+	return authorization(sr, req.Header)
+}
+
+// authorization reads the answer of an authorizer. A local Location
+// without Status is a 302 to the client, the authorizer cannot ask the
+// server to serve another path.
+func authorization(sr *StreamResponse, header http.Header) (Authorization, error) {
+	variables := map[string]string{}
+	for name, values := range sr.Header {
+		if !strings.HasPrefix(name, variablePrefix) {
+			continue
+		}
+		sr.Header.Del(name)
+		name = strings.ToUpper(strings.Replace(name[len(variablePrefix):], "-", "_", -1))
+		variables[name] = strings.Join(values, ", ")
+	}
+	if _, ok := variables["REMOTE_USER"]; ok && variables["AUTH_TYPE"] == "" {
+		if scheme, _, ok := strings.Cut(header.Get("Authorization"), " "); ok {
+			variables["AUTH_TYPE"] = scheme
+		}
+	}
+	if sr.LocalRedirect != "" {
+		sr.StatusCode, sr.Reason, sr.LocalRedirect = http.StatusFound, "", ""
+	}
+	if sr.StatusCode != http.StatusOK {
+		return Authorization{Response: sr}, nil
+	}
+
+	defer sr.Body.Close()
+	if _, err := io.Copy(io.Discard, sr.Body); err != nil {
+		return Authorization{}, fmt.Errorf("cannot read authorizer response : %w", err)
+	}
+	return Authorization{Allowed: true, Variables: variables}, nil
+}
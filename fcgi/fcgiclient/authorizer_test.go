@@ -0,0 +1,107 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		if r.Role != uint16(fcgiprotocol.FCGI_AUTHORIZER) {
+			fmt.Fprintf(w, "Status: 500\r\n\r\nrole %d", r.Role)
+			return
+		}
+		if _, ok := r.Env["CONTENT_LENGTH"]; ok || len(r.Stdin) > 0 {
+			fmt.Fprint(w, "Status: 500\r\n\r\nbody sent")
+			return
+		}
+		switch r.Env["HTTP_AUTHORIZATION"] {
+		case "Bearer bob":
+			fmt.Fprint(w, "Variable-Remote-User: bob\r\nVariable-AUTH_ROLES: admin\r\nX-Other: 1\r\n\r\n")
+		case "Bearer alice":
+			fmt.Fprint(w, "Variable-Remote-User: alice\r\nVariable-Auth-Type: Token\r\n\r\n")
+		case "":
+			fmt.Fprint(w, "Location: /login\r\n\r\n")
+		default:
+			fmt.Fprint(w, "Status: 401 Unauthorized\r\nWWW-Authenticate: Bearer\r\nVariable-Reason: token\r\n\r\ninvalid token")
+		}
+	})
+	defer srv.Close()
+	c := &Client{Dial: srv.Dial, MaxIdleConns: 1}
+
+	tests := map[string]struct {
+		Authorization string
+		Allowed       bool
+		Variables     map[string]string
+		StatusCode    int
+		Header        http.Header
+		Body          string
+	}{
+		"allowed": {
+			Authorization: "Bearer bob",
+			Allowed:       true,
+			Variables:     map[string]string{"REMOTE_USER": "bob", "AUTH_TYPE": "Bearer", "AUTH_ROLES": "admin"},
+		},
+		"allowed with auth type": {
+			Authorization: "Bearer alice",
+			Allowed:       true,
+			Variables:     map[string]string{"REMOTE_USER": "alice", "AUTH_TYPE": "Token"},
+		},
+		"denied": {
+			Authorization: "Bearer eve",
+			StatusCode:    http.StatusUnauthorized,
+			Header:        http.Header{"Status": {"401 Unauthorized"}, "Www-Authenticate": {"Bearer"}},
+			Body:          "invalid token",
+		},
+		"redirected": {
+			StatusCode: http.StatusFound,
+			Header:     http.Header{"Location": {"/login"}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			auth, err := c.Authorize(context.Background(), Request{
+				Method:       "POST",
+				Url:          fcgitest.MustUrl(t, "/admin"),
+				Body:         strings.NewReader("body"),
+				Index:        "auth.php",
+				DocumentRoot: "/srv/auth",
+				Header:       http.Header{"Authorization": {tt.Authorization}},
+			})
+			if err != nil {
+				t.Fatalf("failed authorizing : %v", err)
+			}
+			if auth.Allowed != tt.Allowed {
+				t.Fatalf("want allowed %v got %v", tt.Allowed, auth.Allowed)
+			}
+			if tt.Allowed {
+				if !reflect.DeepEqual(tt.Variables, auth.Variables) {
+					t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Variables, auth.Variables)
+				}
+				return
+			}
+			defer auth.Response.Body.Close()
+			body, err := io.ReadAll(auth.Response.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if auth.Response.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, auth.Response.StatusCode)
+			}
+			if !reflect.DeepEqual(tt.Header, auth.Response.Header) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Header, auth.Response.Header)
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+		})
+	}
+}
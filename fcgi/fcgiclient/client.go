@@ -2,80 +2,433 @@ package fcgiclient
 
 import (
 	"app/fcgi/fcgiprotocol"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
+// DefaultSplitPathInfo is the regular expression nginx documents for
+// fastcgi_split_path_info.
+var DefaultSplitPathInfo = regexp.MustCompile(`^(.+\.php)(/.+)$`)
+
+// SplitPathFunc splits a url path into the script to run and the
+// PATH_INFO given to it, ok is false when the path does not name a
+// script.
+type SplitPathFunc func(urlPath string) (script, pathInfo string, ok bool)
+
+// SplitPathInfo captures the script and the PATH_INFO from the url path
+// with re, like nginx fastcgi_split_path_info. The script must be a file
+// of documentRoot, otherwise a path like /uploads/avatar.jpg/x.php could
+// get an uploaded file run as php.
+func SplitPathInfo(documentRoot string, re *regexp.Regexp) SplitPathFunc {
+	return func(urlPath string) (string, string, bool) {
+		m := re.FindStringSubmatch(urlPath)
+		if len(m) != 3 {
+			return "", "", false
+		}
+		script := path.Clean("/" + m[1])
+		info, err := os.Stat(path.Join(documentRoot, script))
+		if err != nil || !info.Mode().IsRegular() {
+			return "", "", false
+		}
+		return script, m[2], true
+	}
+}
+
 type Request struct {
-	Method       string
-	Url          *url.URL
-	Body         string
-	Index        string
-	DocumentRoot string
-	Env          map[string]string
-	Header       map[string]string
+	// Role is the FastCGI role of the request, FCGI_RESPONDER when zero.
+	// An FCGI_AUTHORIZER request is sent without its body, see Authorize.
+	Role   uint8
+	Method string
+	// Data is the file an FCGI_FILTER request filters, it is sent as the
+	// FCGI_DATA stream with FCGI_DATA_LENGTH and FCGI_DATA_LAST_MOD taken
+	// from DataLength and DataLastMod. DataLength is found like
+	// ContentLength when zero.
+	Data        io.Reader
+	DataLength  int64
+	DataLastMod time.Time
+	Url         *url.URL
+	Body        io.Reader
+	// ContentLength of Body, when zero it is taken from Body if it is a
+	// *bytes.Buffer, *bytes.Reader or *strings.Reader.
+	ContentLength int64
+	Index         string
+	DocumentRoot  string
+	// RemoteRoot is DocumentRoot as php-fpm sees it, when it runs in a
+	// container for instance. SCRIPT_FILENAME, DOCUMENT_ROOT and
+	// PATH_TRANSLATED use it while files are looked up in DocumentRoot.
+	// Empty means the same as DocumentRoot.
+	RemoteRoot string
+	// SplitPath picks the script and the PATH_INFO from the url path,
+	// see SplitPathInfo. Index is run when it is nil or does not match.
+	SplitPath SplitPathFunc
+	// Env is sent after the variables built from the request, in its
+	// order and with its repeated names, a name it holds replaces the
+	// built one.
+	Env fcgiprotocol.Params
+	// Header values sent several times are joined in a single variable,
+	// with "; " for Cookie and ", " for the others.
+	Header http.Header
+	// Stderr receives what the application writes on stderr as it comes.
+	Stderr func([]byte)
+	// EditParams can change the params built from the request right
+	// before they are sent, they are sent in the order it leaves them.
+	EditParams func(params *fcgiprotocol.Params)
 }
 
 type Response struct {
 	AppStatusCode  uint32
 	ProtocolStatus uint8
 	StatusCode     int
-	Header         map[string]string
+	Reason         string
+	Header         http.Header
 	Stdout         string
 	Stderr         string
+	// LocalRedirect is the path the application asked to be served
+	// instead, see fcgiprotocol.Response.
+	LocalRedirect string
+}
+
+// StreamResponse is returned as soon as the header block of the response
+// is read, the rest of stdout is read from Body. Body must be closed, a
+// connection is only reused once Body was read to the end.
+type StreamResponse struct {
+	StatusCode    int
+	Reason        string
+	Header        http.Header
+	LocalRedirect string
+	Body          io.ReadCloser
+	// AppStatusCode and ProtocolStatus are set once Body returned io.EOF.
+	AppStatusCode  uint32
+	ProtocolStatus uint8
 }
 
 func Do(rw io.ReadWriter, req Request) (Response, error) {
+	return readAll(req, func(req Request) (*StreamResponse, error) {
+		return stream(context.Background(), nopCloser{rw}, 0, 0, req, func(bool) {})
+	})
+}
 
-	env := map[string]string{
-		"CONTENT_LENGTH":    fmt.Sprintf("%d", len(req.Body)),
-		"CONTENT_TYPE":      http.DetectContentType([]byte(req.Body[:min(len(req.Body), 512)])),
-		"DOCUMENT_URI":      req.Url.Path,
-		"GATEWAY_INTERFACE": "CGI/1.1",
-		"REQUEST_SCHEME":    "http",
-		"SERVER_PROTOCOL":   "HTTP/1.1",
-		"REQUEST_METHOD":    req.Method,
-		"SCRIPT_FILENAME":   path.Join(req.DocumentRoot, req.Index),
-		"SCRIPT_NAME":       req.Url.Path,
-		"SERVER_SOFTWARE":   "go / fcgiclient ",
-		"DOCUMENT_ROOT":     req.DocumentRoot,
-		"QUERY_STRING":      req.Url.RawQuery,
-		"REQUEST_URI":       req.Url.RequestURI(),
+// DoContext is like Do but sends FCGI_ABORT_REQUEST when ctx is done
+// before the response is over, rwc is closed if the application does not
+// end the request in time.
+func DoContext(ctx context.Context, rwc io.ReadWriteCloser, req Request) (Response, error) {
+	return readAll(req, func(req Request) (*StreamResponse, error) {
+		return stream(ctx, rwc, 0, 0, req, func(bool) {})
+	})
+}
+
+// Stream sends the request and returns once the header block of the
+// response is read, ctx is handled as in DoContext.
+func Stream(ctx context.Context, rwc io.ReadWriteCloser, req Request) (*StreamResponse, error) {
+	return stream(ctx, rwc, 0, 0, req, func(bool) {})
+}
+
+// stream calls release once the response is over, reusable tells whether
+// the connection can carry another request. maxParamsLen is
+// fcgiprotocol.MaxParamsLen when zero.
+func stream(ctx context.Context, rwc io.ReadWriteCloser, flags uint8, maxParamsLen int, req Request, release func(reusable bool)) (*StreamResponse, error) {
+	env, body := buildEnv(req)
+	stderr := &stderrBuffer{next: req.Stderr}
+	rr, err := fcgiprotocol.StreamRole(ctx, rwc, req.role(), flags, env, maxParamsLen, body, req.Data, stderr.write)
+	if err != nil {
+		release(false)
+		return nil, fmt.Errorf("cannot send fcgi request: %w", err)
 	}
+	return newStreamResponse(rr, stderr, release)
+}
 
-	for header, values := range req.Header {
-		env["HTTP_"+strings.Replace(strings.ToUpper(header), "-", "_", -1)] = values
+func newStreamResponse(rr *fcgiprotocol.ResponseReader, stderr *stderrBuffer, release func(reusable bool)) (*StreamResponse, error) {
+	sr := &StreamResponse{}
+	body := &responseBody{rr: rr, sr: sr, stderr: stderr, release: release}
+	br := bufio.NewReader(body)
+	rsp, err := fcgiprotocol.ReadResponseHeader(br)
+	if err != nil {
+		body.Close()
+		if body.err != nil && body.err != io.EOF {
+			return nil, fmt.Errorf("cannot send fcgi request: %w", body.err)
+		}
+		return nil, fmt.Errorf("cannot read fcgi reqponse: %w", err)
 	}
+	sr.StatusCode = rsp.StatusCode
+	sr.Reason = rsp.Reason
+	sr.Header = rsp.Headers
+	sr.LocalRedirect = rsp.LocalRedirect
+	sr.Body = readCloser{Reader: br, Closer: body}
+	return sr, nil
+}
 
-	if ct, ok := env["HTTP_CONTENT_TYPE"]; ok {
-		env["CONTENT_TYPE"] = ct
+// readAll buffers the whole response of the request opened by open.
+func readAll(req Request, open func(req Request) (*StreamResponse, error)) (Response, error) {
+	stderr := []byte{}
+	onStderr := req.Stderr
+	req.Stderr = func(b []byte) {
+		stderr = append(stderr, b...)
+		if onStderr != nil {
+			onStderr(b)
+		}
+	}
+	sr, err := open(req)
+	if err != nil {
+		return Response{}, fmt.Errorf("%w : stderr '%s'", err, string(stderr))
+	}
+	defer sr.Body.Close()
+	stdout, err := io.ReadAll(sr.Body)
+	var appErr *fcgiprotocol.AppError
+	if err != nil && !errors.As(err, &appErr) {
+		return Response{}, fmt.Errorf("cannot send fcgi request: %w : stderr '%s'", err, string(stderr))
 	}
 
-	for name, value := range req.Env {
-		env[name] = value
+	rsp := Response{
+		StatusCode:     sr.StatusCode,
+		Reason:         sr.Reason,
+		AppStatusCode:  sr.AppStatusCode,
+		ProtocolStatus: sr.ProtocolStatus,
+		Header:         sr.Header,
+		Stdout:         string(stdout),
+		Stderr:         string(stderr),
+		LocalRedirect:  sr.LocalRedirect,
 	}
+	if appErr != nil {
+		return rsp, appErr
+	}
+	return rsp, nil
+}
 
-	rawRsp, err := fcgiprotocol.Do(rw, env, req.Body)
+// responseBody returns an *fcgiprotocol.AppError instead of io.EOF when
+// the application ended with a non zero app status.
+type responseBody struct {
+	rr       *fcgiprotocol.ResponseReader
+	sr       *StreamResponse
+	stderr   *stderrBuffer
+	release  func(reusable bool)
+	released bool
+	err      error
+}
 
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.rr.Read(p)
 	if err != nil {
-		return Response{}, fmt.Errorf("cannot send fcgi request: %w : stderr '%s'", err, string(rawRsp.Stderr))
+		b.err = err
+		b.done(err == io.EOF)
 	}
+	if err == io.EOF && b.rr.AppStatus != 0 {
+		err = &fcgiprotocol.AppError{AppStatus: b.rr.AppStatus, Stderr: b.stderr.buf}
+	}
+	return n, err
+}
 
-	rsp, err := fcgiprotocol.ParseResponse(fmt.Sprintf("%s", rawRsp.Stdout))
-	if err != nil {
-		return Response{}, fmt.Errorf("cannot read fcgi reqponse: %w : stderr '%s'", err, string(rawRsp.Stderr))
+// stderrBuffer keeps what the application writes on stderr for its
+// AppError while passing it along to next.
+type stderrBuffer struct {
+	next func([]byte)
+	buf  []byte
+}
+
+func (s *stderrBuffer) write(b []byte) {
+	s.buf = append(s.buf, b...)
+	if s.next != nil {
+		s.next(b)
 	}
+}
 
-	return Response{
-		StatusCode:     rsp.StatusCode,
-		AppStatusCode:  rawRsp.AppStatus,
-		ProtocolStatus: rawRsp.ProtocolStatus,
-		Header:         rsp.Headers,
-		Stdout:         rsp.Stdout,
-		Stderr:         string(rawRsp.Stderr),
-	}, nil
+func (b *responseBody) Close() error {
+	if !b.released {
+		b.rr.Close()
+		b.done(false)
+	}
+	return nil
+}
+
+func (b *responseBody) done(reusable bool) {
+	if b.released {
+		return
+	}
+	b.released = true
+	b.sr.AppStatusCode = b.rr.AppStatus
+	b.sr.ProtocolStatus = b.rr.ProtocolStatus
+	b.release(reusable)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error { return nil }
+
+func buildEnv(req Request) (fcgiprotocol.Params, io.Reader) {
+	contentType, body := req.Header.Get("Content-Type"), req.Body
+	if contentType == "" && body != nil && contentLength(req) > 0 {
+		contentType, body = detectContentType(body)
+	}
+	root := req.remoteRoot()
+	env := fcgiprotocol.ParamsFromMap(CGIEnv(req.httpRequest(), ServerInfo{}))
+	// Index runs when the path names no script, SCRIPT_NAME is then its
+	// url as RFC 3875 wants SCRIPT_NAME to name SCRIPT_FILENAME
+	env.Override(fcgiprotocol.Params{
+		{Key: "CONTENT_LENGTH", Value: fmt.Sprintf("%d", contentLength(req))},
+		{Key: "DOCUMENT_URI", Value: req.Url.Path},
+		{Key: "REQUEST_METHOD", Value: req.Method},
+		{Key: "SCRIPT_FILENAME", Value: path.Join(root, req.Index)},
+		{Key: "SCRIPT_NAME", Value: path.Join("/", req.Index)},
+		{Key: "SERVER_SOFTWARE", Value: "go / fcgiclient "},
+		{Key: "DOCUMENT_ROOT", Value: root},
+		{Key: "QUERY_STRING", Value: req.Url.RawQuery},
+		{Key: "REQUEST_URI", Value: req.Url.RequestURI()},
+	})
+
+	if script, pathInfo, ok := req.splitPath(); ok {
+		env.Set("SCRIPT_FILENAME", path.Join(root, script))
+		env.Set("SCRIPT_NAME", script)
+		env.Set("PATH_INFO", pathInfo)
+		if pathInfo != "" {
+			env.Set("PATH_TRANSLATED", path.Join(root, pathInfo))
+		}
+	}
+
+	if contentType != "" {
+		env.Set("CONTENT_TYPE", contentType)
+	}
+
+	// headers are sent sorted so that a request always gets the same params
+	headers := make([]string, 0, len(req.Header))
+	for header := range req.Header {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	for _, header := range headers {
+		if !forwardHeader(header) {
+			continue
+		}
+		sep := ", "
+		if http.CanonicalHeaderKey(header) == "Cookie" {
+			sep = "; "
+		}
+		env.Set("HTTP_"+strings.Replace(strings.ToUpper(header), "-", "_", -1), strings.Join(req.Header[header], sep))
+	}
+
+	if req.role() == fcgiprotocol.FCGI_AUTHORIZER {
+		// the FastCGI specification, section 6.3, leaves them out
+		env.Del("CONTENT_LENGTH")
+		env.Del("PATH_INFO")
+		env.Del("PATH_TRANSLATED")
+		env.Del("SCRIPT_NAME")
+		body = nil
+	}
+	if req.role() == fcgiprotocol.FCGI_FILTER {
+		env.Set("FCGI_DATA_LENGTH", fmt.Sprintf("%d", dataLength(req)))
+		env.Set("FCGI_DATA_LAST_MOD", fmt.Sprintf("%d", req.DataLastMod.Unix()))
+	}
+
+	env.Override(req.Env)
+
+	if req.EditParams != nil {
+		req.EditParams(&env)
+	}
+
+	return env, body
+}
+
+// forwardHeader tells whether a header is sent as an HTTP_ variable.
+// Content-Type and Content-Length already are CONTENT_TYPE and
+// CONTENT_LENGTH. Proxy would be HTTP_PROXY which many http clients take
+// as their proxy (httpoxy), and a name holding an underscore could pass
+// for the one of another header, X_Forwarded_For for X-Forwarded-For.
+func forwardHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Content-Type", "Content-Length", "Proxy":
+		return false
+	}
+	return !strings.Contains(name, "_")
+}
+
+func (req Request) role() uint8 {
+	if req.Role == 0 {
+		return fcgiprotocol.FCGI_RESPONDER
+	}
+	return req.Role
+}
+
+// httpRequest is what CGIEnv needs of the request, the scheme and the
+// host come from Url.
+func (req Request) httpRequest() *http.Request {
+	return &http.Request{Method: req.Method, URL: req.Url, Host: req.Url.Host, Header: req.Header}
+}
+
+func (req Request) remoteRoot() string {
+	if req.RemoteRoot != "" {
+		return req.RemoteRoot
+	}
+	return req.DocumentRoot
+}
+
+func (req Request) splitPath() (string, string, bool) {
+	if req.SplitPath == nil {
+		return "", "", false
+	}
+	return req.SplitPath(req.Url.Path)
+}
+
+func contentLength(req Request) int64 {
+	if req.ContentLength != 0 {
+		return req.ContentLength
+	}
+	return readerLen(req.Body)
+}
+
+func dataLength(req Request) int64 {
+	if req.DataLength != 0 {
+		return req.DataLength
+	}
+	return readerLen(req.Data)
+}
+
+// readerLen is the length of the readers which know it, 0 for the others.
+func readerLen(r io.Reader) int64 {
+	switch b := r.(type) {
+	case *bytes.Buffer:
+		return int64(b.Len())
+	case *bytes.Reader:
+		return int64(b.Len())
+	case *strings.Reader:
+		return int64(b.Len())
+	}
+	return 0
+}
+
+// detectContentType looks at the first bytes of body without consuming
+// them, the returned reader must be sent instead of body.
+func detectContentType(body io.Reader) (string, io.Reader) {
+	if body == nil {
+		return http.DetectContentType(nil), nil
+	}
+	if rs, ok := body.(io.ReadSeeker); ok {
+		offset, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			b := make([]byte, 512)
+			n, _ := io.ReadFull(rs, b)
+			if _, err := rs.Seek(offset, io.SeekStart); err == nil {
+				return http.DetectContentType(b[:n]), body
+			}
+		}
+	}
+	br := bufio.NewReaderSize(body, 512)
+	b, _ := br.Peek(512)
+	return http.DetectContentType(b), br
 }
@@ -2,42 +2,20 @@ package fcgiclient
 
 import (
 	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"reflect"
 	"strings"
 	"testing"
-	"time"
 )
 
-func runPhpFpmServer(t *testing.T) (string, func() error) {
-	t.Helper()
-	cwd, _ := os.Getwd()
-	cwd = path.Join(cwd, "../../php-fpm")
-	t.Logf("dir is %s", cwd)
-	// binary can be downloaded from https://dl.static-php.dev/static-php-cli/common/
-	cmd := exec.Command("./php-fpm", "-y", path.Join(cwd, "php-fpm.conf"), "-p", cwd)
-	cmd.Dir = cwd
-	err := cmd.Start()
-	if err != nil {
-		t.Fatalf("cannot start php-fpm : %v", err)
-	}
-	time.Sleep(time.Second)
-	return cwd, cmd.Process.Kill
-}
-
-func MustUrl(t *testing.T, rawUrl string) *url.URL {
-	t.Helper()
-	u, err := url.Parse(rawUrl)
-	if err != nil {
-		t.Fatalf("cannot parse url %s : %v", rawUrl, err)
-	}
-	return u
-}
-
 func buildAStringOfLen(n int) string {
 	dict := []rune("abcdefghijklmnopqrstuvwxyz")
 	b := make([]rune, n)
@@ -48,14 +26,11 @@ func buildAStringOfLen(n int) string {
 }
 
 func TestDo(t *testing.T) {
-	dir, closer := runPhpFpmServer(t)
-	defer func() {
-		if err := closer(); err != nil {
-			t.Fatalf("failed to kill process: %v", err)
-		}
-	}()
+	srv := fcgitest.NewServer(fcgitest.EchoHandler)
+	defer srv.Close()
+	dir := fcgitest.DocumentRoot(t)
 	tooLongString := buildAStringOfLen(fcgiprotocol.MaxWrite)
-	toolongPairValue := buildAStringOfLen(fcgiprotocol.MaxPairLen)
+	bigHeaderValue := buildAStringOfLen(40000)
 
 	tests := map[string]struct {
 		In       Request
@@ -66,18 +41,17 @@ func TestDo(t *testing.T) {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/"),
 				Index:        "wrong.php",
-				Env:          map[string]string{},
-				Header:       map[string]string{},
+				Env:          fcgiprotocol.Params{},
+				Header:       http.Header{},
 			},
 			Expected: Response{
 				StatusCode: 404,
-				Header: map[string]string{
-					"Content-type": "text/html; charset=UTF-8",
-					"X-Powered-By": "PHP/8.3.7",
-					"Status":       "404 Not Found",
+				Reason:     "Not Found",
+				Header: http.Header{
+					"Content-Type": {"text/html; charset=UTF-8"},
+					"Status":       {"404 Not Found"},
 				},
 				Stdout: "File not found.\n",
 				Stderr: "Primary script unknown",
@@ -87,18 +61,16 @@ func TestDo(t *testing.T) {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header:       map[string]string{},
+				Env:          fcgiprotocol.Params{},
+				Header:       http.Header{},
 			},
 			Expected: Response{
 				StatusCode: 200,
-				Header: map[string]string{
-					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
-					"X-Request-Uri": "/",
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1>",
@@ -108,7 +80,6 @@ func TestDo(t *testing.T) {
 					"<h1>Headers:</h1>",
 					"<pre>",
 					"Content-Length: 0",
-					"Content-Type: text/plain; charset=utf-8",
 					"</pre>",
 					"<h1>Body:</h1>",
 					"<pre>",
@@ -121,21 +92,20 @@ func TestDo(t *testing.T) {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/?status_code=403"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/?status_code=403"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header:       map[string]string{},
+				Env:          fcgiprotocol.Params{},
+				Header:       http.Header{},
 			},
 			Expected: Response{
 				StatusCode: 403,
-				Header: map[string]string{
-					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
-					"X-Request-Uri": "/?status_code=403",
-					"Status":        "403 Forbidden",
-					"X-Status-Code": "403",
-					"Status-Code":   "403",
+				Reason:     "Forbidden",
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/?status_code=403"},
+					"Status":        {"403 Forbidden"},
+					"X-Status-Code": {"403"},
+					"Status-Code":   {"403"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1>",
@@ -145,7 +115,6 @@ func TestDo(t *testing.T) {
 					"<h1>Headers:</h1>",
 					"<pre>",
 					"Content-Length: 0",
-					"Content-Type: text/plain; charset=utf-8",
 					"</pre>",
 					"<h1>Body:</h1>",
 					"<pre>",
@@ -158,23 +127,21 @@ func TestDo(t *testing.T) {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "OPTIONS",
-				Url:          MustUrl(t, "/api/users"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/api/users"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header: map[string]string{
-					"Access-Control-Request-Method":  "POST",
-					"Access-Control-Request-Headers": "content-type",
-					"Referer":                        "https://verification.exemple.com/",
-					"Origin":                         "https://verification.exemple.com/",
+				Env:          fcgiprotocol.Params{},
+				Header: http.Header{
+					"Access-Control-Request-Method":  {"POST"},
+					"Access-Control-Request-Headers": {"content-type"},
+					"Referer":                        {"https://verification.exemple.com/"},
+					"Origin":                         {"https://verification.exemple.com/"},
 				},
 			},
 			Expected: Response{
 				StatusCode: 200,
-				Header: map[string]string{
-					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
-					"X-Request-Uri": "/api/users",
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/api/users"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1>",
@@ -186,7 +153,6 @@ func TestDo(t *testing.T) {
 					"Access-Control-Request-Headers: content-type",
 					"Access-Control-Request-Method: POST",
 					"Content-Length: 0",
-					"Content-Type: text/plain; charset=utf-8",
 					"Origin: https://verification.exemple.com/",
 					"Referer: https://verification.exemple.com/",
 					"</pre>",
@@ -201,20 +167,19 @@ func TestDo(t *testing.T) {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "POST",
-				Url:          MustUrl(t, "/api/auth-tokens"),
-				Body:         `{"login":admin","password":"azertyu"}` + "\n",
+				Url:          fcgitest.MustUrl(t, "/api/auth-tokens"),
+				Body:         strings.NewReader(`{"login":admin","password":"azertyu"}` + "\n"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header: map[string]string{
-					"Content-type": "application/json",
+				Env:          fcgiprotocol.Params{},
+				Header: http.Header{
+					"Content-Type": {"application/json"},
 				},
 			},
 			Expected: Response{
 				StatusCode: 200,
-				Header: map[string]string{
-					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
-					"X-Request-Uri": "/api/auth-tokens",
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/api/auth-tokens"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1>",
@@ -238,18 +203,17 @@ func TestDo(t *testing.T) {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/"),
-				Body:         "test: " + tooLongString + "\n",
+				Url:          fcgitest.MustUrl(t, "/"),
+				Body:         strings.NewReader("test: " + tooLongString + "\n"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header:       map[string]string{},
+				Env:          fcgiprotocol.Params{},
+				Header:       http.Header{},
 			},
 			Expected: Response{
 				StatusCode: 200,
-				Header: map[string]string{
-					"Content-type":  "text/html; charset=UTF-8",
-					"X-Powered-By":  "PHP/8.3.7",
-					"X-Request-Uri": "/",
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1>",
@@ -269,77 +233,91 @@ func TestDo(t *testing.T) {
 				Stderr: "",
 			},
 		},
-		"too long pair fcgiprotocol.MaxKeyPairLen": {
+		"params len over fcgiprotocol.MaxWrite": {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header: map[string]string{
-					"Value_Which_Overflow_Pairs": toolongPairValue,
+				Env:          fcgiprotocol.Params{},
+				Header: http.Header{
+					"X-Big-A": {bigHeaderValue},
+					"X-Big-B": {bigHeaderValue},
 				},
 			},
-			Expected: Response{},
-			Error:    "cannot send fcgi request: cant write req : build pair len exceed MaxPairLen of (65535) : stderr ''",
+			Expected: Response{
+				StatusCode: 200,
+				Header: http.Header{
+					"Content-Type":  {"text/html; charset=UTF-8"},
+					"X-Request-Uri": {"/"},
+				},
+				Stdout: strings.Join([]string{
+					"<h1>Requested URL:</h1>",
+					"<p>/</p>",
+					"<h1>Request Method:</h1>",
+					"<p>GET</p>",
+					"<h1>Headers:</h1>",
+					"<pre>",
+					"Content-Length: 0",
+					"X-Big-A: " + bigHeaderValue,
+					"X-Big-B: " + bigHeaderValue,
+					"</pre>",
+					"<h1>Body:</h1>",
+					"<pre>",
+					"</pre>",
+				}, "\n"),
+				Stderr: "",
+			},
 		},
+		// the response of a script exiting with a non zero status comes
+		// along with its *fcgiprotocol.AppError
 		"exception": {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/?throw=true"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/?throw=true"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header:       map[string]string{},
+				Env:          fcgiprotocol.Params{},
+				Header:       http.Header{},
 			},
 			Expected: Response{
-				StatusCode: 200,
-				Header: map[string]string{
-					"Content-type": "text/html; charset=UTF-8",
-					"X-Powered-By": "PHP/8.3.7",
+				AppStatusCode: 255,
+				StatusCode:    200,
+				Header: http.Header{
+					"Content-Type": {"text/html; charset=UTF-8"},
 				},
-				Stdout: strings.Join([]string{
-					"<br />",
-					"<b>Fatal error</b>:  Uncaught Exception: throw exception in " + dir + "/index.php:6",
-					"Stack trace:\n#0 {main}",
-					"  thrown in <b>" + dir + "/index.php</b> on line <b>6</b><br />\n",
-				}, "\n"),
-				Stderr: strings.Join([]string{
-					"PHP message: PHP Fatal error:  Uncaught Exception: throw exception in " + dir + "/index.php:6",
-					"Stack trace:\n#0 {main}",
-					"  thrown in " + dir + "/index.php on line 6",
-				}, "\n"),
+				Stdout: "<br />\n<b>Fatal error</b>:  Uncaught Exception: throw exception<br />\n",
+				Stderr: "PHP message: PHP Fatal error:  Uncaught Exception: throw exception",
 			},
+			Error: "fcgi: application exited with status 255 : stderr 'PHP message: PHP Fatal error:  Uncaught Exception: throw exception'",
 		},
 		"die": {
 			In: Request{
 				DocumentRoot: dir,
 				Method:       "GET",
-				Url:          MustUrl(t, "/?die=true"),
-				Body:         "",
+				Url:          fcgitest.MustUrl(t, "/?die=true"),
 				Index:        "index.php",
-				Env:          map[string]string{},
-				Header:       map[string]string{},
+				Env:          fcgiprotocol.Params{},
+				Header:       http.Header{},
 			},
 			Expected: Response{
-				StatusCode: 200,
-				Header: map[string]string{
-					"Content-type": "text/html; charset=UTF-8",
-					"X-Powered-By": "PHP/8.3.7",
+				AppStatusCode: 1,
+				StatusCode:    200,
+				Header: http.Header{
+					"Content-Type": {"text/html; charset=UTF-8"},
 				},
 				Stdout: "",
 				Stderr: "",
 			},
+			Error: "fcgi: application exited with status 1 : stderr ''",
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			conn, err := net.Dial("tcp", "127.0.0.1:9000")
+			conn, err := srv.Dial()
 			if err != nil {
-				t.Fatalf("cannot dial php server : %v", err)
+				t.Fatalf("cannot dial fcgi server : %v", err)
 			}
 			defer conn.Close()
 			result, err := Do(conn, tt.In)
@@ -351,6 +329,70 @@ func TestDo(t *testing.T) {
 	}
 }
 
+func TestStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	unblock := make(chan struct{})
+	go func() {
+		defer server.Close()
+		stdin := []byte{}
+		for {
+			rec := fcgiprotocol.Record{}
+			if err := rec.Read(server); err != nil {
+				return
+			}
+			if rec.Header.Type != fcgiprotocol.FCGI_STDIN {
+				continue
+			}
+			if len(rec.Content()) == 0 {
+				break
+			}
+			stdin = append(stdin, rec.Content()...)
+		}
+		w := fcgiprotocol.RawRecordWriter(server)
+		w(fcgiprotocol.FCGI_STDERR, 1, []byte("warning"))
+		w(fcgiprotocol.FCGI_STDOUT, 1, []byte("Status: 201 Created\r\nContent-type: text/plain\r\n\r\nfirst "))
+		<-unblock
+		w(fcgiprotocol.FCGI_STDOUT, 1, []byte(fmt.Sprintf("received %d bytes", len(stdin))))
+		w(fcgiprotocol.FCGI_END_REQUEST, 1, []byte{0, 0, 0, 3, 0, 0, 0, 0})
+	}()
+
+	stderr := ""
+	rsp, err := Stream(context.Background(), client, Request{
+		Method: "POST",
+		Url:    fcgitest.MustUrl(t, "/upload"),
+		Index:  "index.php",
+		Body:   strings.NewReader(buildAStringOfLen(3 * fcgiprotocol.MaxWrite)),
+		Stderr: func(b []byte) { stderr += string(b) },
+	})
+	if err != nil {
+		t.Fatalf("failed running request : %v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 201 || rsp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected response header %#v", rsp)
+	}
+	first := make([]byte, 6)
+	if _, err := io.ReadFull(rsp.Body, first); err != nil || string(first) != "first " {
+		t.Fatalf("want first part of body got '%s' : %v", first, err)
+	}
+	close(unblock)
+	rest, err := io.ReadAll(rsp.Body)
+	var appErr *fcgiprotocol.AppError
+	if !errors.As(err, &appErr) || appErr.AppStatus != 3 || string(appErr.Stderr) != "warning" {
+		t.Fatalf("want app error with status 3 got %#v", err)
+	}
+	if want := fmt.Sprintf("received %d bytes", 3*fcgiprotocol.MaxWrite); string(rest) != want {
+		t.Fatalf("want %s got %s", want, rest)
+	}
+	if stderr != "warning" {
+		t.Fatalf("want stderr warning got %s", stderr)
+	}
+	if rsp.AppStatusCode != 3 {
+		t.Fatalf("want app status 3 got %d", rsp.AppStatusCode)
+	}
+}
+
 func testError(t *testing.T, got error, want string) {
 	t.Helper()
 	if got != nil {
@@ -369,3 +411,182 @@ func testError(t *testing.T, got error, want string) {
 		}
 	}
 }
+
+func TestBuildEnvHeader(t *testing.T) {
+	env, _ := buildEnv(Request{
+		Method: "GET",
+		Url:    fcgitest.MustUrl(t, "/"),
+		Header: http.Header{
+			"Cookie":          {"a=1", "b=2"},
+			"Accept-Encoding": {"gzip", "br"},
+			"X-Single":        {"one"},
+			"Content-Type":    {"application/json"},
+			"Proxy":           {"http://attacker:8080"},
+			"X_Single":        {"spoofed"},
+		},
+	})
+	want := map[string]string{
+		"HTTP_COOKIE":          "a=1; b=2",
+		"HTTP_ACCEPT_ENCODING": "gzip, br",
+		"HTTP_X_SINGLE":        "one",
+		"CONTENT_TYPE":         "application/json",
+	}
+	for name, value := range want {
+		if env.Get(name) != value {
+			t.Fatalf("want %s to be '%s' got '%s'", name, value, env.Get(name))
+		}
+	}
+	for _, name := range []string{"HTTP_CONTENT_TYPE", "HTTP_PROXY"} {
+		if value, ok := env.Lookup(name); ok {
+			t.Fatalf("want %s unset got '%s'", name, value)
+		}
+	}
+}
+
+func TestDoParamsOrder(t *testing.T) {
+	var got fcgiprotocol.Params
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		got = r.Params
+		fmt.Fprint(w, "Content-type: text/plain\r\n\r\n")
+	})
+	defer srv.Close()
+	conn, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("cannot dial : %v", err)
+	}
+	defer conn.Close()
+
+	_, err = Do(conn, Request{
+		Method: "GET",
+		Url:    fcgitest.MustUrl(t, "/"),
+		Env: fcgiprotocol.Params{
+			{Key: "Z_VAR", Value: "1"},
+			{Key: "REQUEST_METHOD", Value: "PUT"},
+			{Key: "Z_VAR", Value: "2"},
+		},
+		EditParams: func(params *fcgiprotocol.Params) {
+			params.Add("A_VAR", "3")
+		},
+	})
+	if err != nil {
+		t.Fatalf("Do failed : %v", err)
+	}
+	want := fcgiprotocol.Params{
+		{Key: "Z_VAR", Value: "1"},
+		{Key: "REQUEST_METHOD", Value: "PUT"},
+		{Key: "Z_VAR", Value: "2"},
+		{Key: "A_VAR", Value: "3"},
+	}
+	if len(got) < len(want) || !reflect.DeepEqual(want, got[len(got)-len(want):]) {
+		t.Fatalf("want the params to end with \n%#v\ngot \n%#v\n", want, got)
+	}
+	if methods := got.Values("REQUEST_METHOD"); len(methods) != 1 {
+		t.Fatalf("want REQUEST_METHOD replaced got %#v", methods)
+	}
+}
+
+func TestBuildEnvContentType(t *testing.T) {
+	tests := map[string]struct {
+		In          Request
+		ContentType string
+		Set         bool
+	}{
+		"get without body": {
+			In: Request{Method: "GET", Url: fcgitest.MustUrl(t, "/")},
+		},
+		"body without header": {
+			In:          Request{Method: "POST", Url: fcgitest.MustUrl(t, "/"), Body: strings.NewReader(`{"a":1}`)},
+			ContentType: "text/plain; charset=utf-8",
+			Set:         true,
+		},
+		"header": {
+			In: Request{
+				Method: "POST",
+				Url:    fcgitest.MustUrl(t, "/"),
+				Body:   strings.NewReader(`{"a":1}`),
+				Header: http.Header{"Content-Type": {"application/json"}},
+			},
+			ContentType: "application/json",
+			Set:         true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			env, _ := buildEnv(tt.In)
+			contentType, ok := env.Lookup("CONTENT_TYPE")
+			if ok != tt.Set || contentType != tt.ContentType {
+				t.Fatalf("want CONTENT_TYPE '%s' %v got '%s' %v", tt.ContentType, tt.Set, contentType, ok)
+			}
+		})
+	}
+}
+
+func TestBuildEnvSplitPathInfo(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "app.php"), nil, 0o644); err != nil {
+		t.Fatalf("cannot create app.php : %v", err)
+	}
+	if err := os.Mkdir(path.Join(dir, "dir.php"), 0o755); err != nil {
+		t.Fatalf("cannot create dir.php : %v", err)
+	}
+
+	tests := map[string]struct {
+		Url      string
+		Expected map[string]string
+	}{
+		"script with path info": {
+			Url: "/app.php/users/42?page=1",
+			Expected: map[string]string{
+				"SCRIPT_FILENAME": path.Join(dir, "app.php"),
+				"SCRIPT_NAME":     "/app.php",
+				"PATH_INFO":       "/users/42",
+				"PATH_TRANSLATED": path.Join(dir, "users/42"),
+			},
+		},
+		"no path info": {
+			Url: "/users/42",
+			Expected: map[string]string{
+				"SCRIPT_FILENAME": path.Join(dir, "index.php"),
+				"SCRIPT_NAME":     "/index.php",
+				"PATH_INFO":       "",
+				"PATH_TRANSLATED": "",
+			},
+		},
+		"missing script": {
+			Url: "/uploads/avatar.jpg/x.php/run",
+			Expected: map[string]string{
+				"SCRIPT_FILENAME": path.Join(dir, "index.php"),
+				"SCRIPT_NAME":     "/index.php",
+				"PATH_INFO":       "",
+				"PATH_TRANSLATED": "",
+			},
+		},
+		"script is a directory": {
+			Url: "/dir.php/users",
+			Expected: map[string]string{
+				"SCRIPT_FILENAME": path.Join(dir, "index.php"),
+				"SCRIPT_NAME":     "/index.php",
+				"PATH_INFO":       "",
+				"PATH_TRANSLATED": "",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			env, _ := buildEnv(Request{
+				Method:       "GET",
+				Url:          fcgitest.MustUrl(t, tt.Url),
+				Index:        "index.php",
+				DocumentRoot: dir,
+				SplitPath:    SplitPathInfo(dir, DefaultSplitPathInfo),
+			})
+			for name, value := range tt.Expected {
+				if env.Get(name) != value {
+					t.Fatalf("want %s to be '%s' got '%s'", name, value, env.Get(name))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package fcgiclient
+
+import (
+	"net"
+	"net/http"
+)
+
+// ServerInfo describes the web server sending the request, empty fields
+// are taken from the request.
+type ServerInfo struct {
+	// Name is SERVER_NAME, the host of the request when empty.
+	Name string
+	// Addr is SERVER_ADDR, left unset when empty.
+	Addr string
+	// Port is SERVER_PORT, the port of the host of the request or the
+	// one of its scheme when empty.
+	Port string
+}
+
+// CGIEnv returns the RFC 3875 variables describing r and the server which
+// received it, the variables depending on the script and the HTTP_ ones
+// are added by the Request.
+func CGIEnv(r *http.Request, srv ServerInfo) map[string]string {
+	https := r.TLS != nil || r.URL.Scheme == "https"
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REQUEST_SCHEME":    "http",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		// php built with force-cgi-redirect refuses to run without it
+		"REDIRECT_STATUS": "200",
+	}
+	if https {
+		env["HTTPS"] = "on"
+		env["REQUEST_SCHEME"] = "https"
+	}
+	if r.Proto != "" {
+		env["SERVER_PROTOCOL"] = r.Proto
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	if host != "" {
+		env["SERVER_NAME"], env["SERVER_PORT"] = splitHostPort(host, https)
+	}
+	if srv.Name != "" {
+		env["SERVER_NAME"] = srv.Name
+	}
+	if srv.Port != "" {
+		env["SERVER_PORT"] = srv.Port
+	}
+	if srv.Addr != "" {
+		env["SERVER_ADDR"] = srv.Addr
+	}
+
+	if r.RemoteAddr != "" {
+		env["REMOTE_ADDR"], env["REMOTE_PORT"] = splitIPAndPort(r.RemoteAddr)
+	}
+	// AUTH_TYPE and REMOTE_USER are left to what really authenticated the
+	// request, like an authorizer, the Authorization header is whatever
+	// the client wrote
+	return env
+}
+
+// splitHostPort returns the port of the scheme when hostport has none.
+func splitHostPort(hostport string, https bool) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err == nil {
+		return host, port
+	}
+	if https {
+		return hostport, "443"
+	}
+	return hostport, "80"
+}
@@ -0,0 +1,85 @@
+package fcgiclient
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCGIEnv(t *testing.T) {
+	tests := map[string]struct {
+		Request  func() *http.Request
+		Server   ServerInfo
+		Expected map[string]string
+	}{
+		"plain http": {
+			Request: func() *http.Request {
+				r := httptest.NewRequest("GET", "http://exemple.com/users", nil)
+				r.RemoteAddr = "10.0.0.1:5000"
+				return r
+			},
+			Expected: map[string]string{
+				"GATEWAY_INTERFACE": "CGI/1.1",
+				"REQUEST_SCHEME":    "http",
+				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REDIRECT_STATUS":   "200",
+				"SERVER_NAME":       "exemple.com",
+				"SERVER_PORT":       "80",
+				"REMOTE_ADDR":       "10.0.0.1",
+				"REMOTE_PORT":       "5000",
+			},
+		},
+		"https over http2 with unverified basic auth": {
+			Request: func() *http.Request {
+				r := httptest.NewRequest("GET", "https://exemple.com:8443/users", nil)
+				r.TLS = &tls.ConnectionState{}
+				r.Proto = "HTTP/2.0"
+				r.RemoteAddr = "[::1]:5000"
+				r.SetBasicAuth("admin", "secret")
+				return r
+			},
+			Expected: map[string]string{
+				"GATEWAY_INTERFACE": "CGI/1.1",
+				"REQUEST_SCHEME":    "https",
+				"HTTPS":             "on",
+				"SERVER_PROTOCOL":   "HTTP/2.0",
+				"REDIRECT_STATUS":   "200",
+				"SERVER_NAME":       "exemple.com",
+				"SERVER_PORT":       "8443",
+				"REMOTE_ADDR":       "::1",
+				"REMOTE_PORT":       "5000",
+			},
+		},
+		"server info and bearer token": {
+			Request: func() *http.Request {
+				r := httptest.NewRequest("GET", "http://exemple.com/users", nil)
+				r.RemoteAddr = "10.0.0.1:5000"
+				r.Header.Set("Authorization", "Bearer token")
+				return r
+			},
+			Server: ServerInfo{Name: "localhost", Addr: "1.2.3.4", Port: "443"},
+			Expected: map[string]string{
+				"GATEWAY_INTERFACE": "CGI/1.1",
+				"REQUEST_SCHEME":    "http",
+				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REDIRECT_STATUS":   "200",
+				"SERVER_NAME":       "localhost",
+				"SERVER_ADDR":       "1.2.3.4",
+				"SERVER_PORT":       "443",
+				"REMOTE_ADDR":       "10.0.0.1",
+				"REMOTE_PORT":       "5000",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			env := CGIEnv(tt.Request(), tt.Server)
+			if !reflect.DeepEqual(env, tt.Expected) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, env)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"fmt"
+	"os"
+)
+
+// FilterFile returns req as an FCGI_FILTER request sending f as its
+// FCGI_DATA stream, f must stay open until the response is read.
+func FilterFile(req Request, f *os.File) (Request, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return req, fmt.Errorf("cannot stat filtered file : %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return req, fmt.Errorf("cannot filter %s : not a regular file", f.Name())
+	}
+	req.Role = fcgiprotocol.FCGI_FILTER
+	req.Data = f
+	req.DataLength = info.Size()
+	req.DataLastMod = info.ModTime()
+	return req, nil
+}
@@ -0,0 +1,58 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterFile(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		if r.Role != uint16(fcgiprotocol.FCGI_FILTER) {
+			fmt.Fprintf(w, "Status: 500\r\n\r\nrole %d", r.Role)
+			return
+		}
+		fmt.Fprintf(w, "Content-type: text/html\r\n\r\n%s %s %s", r.Env["FCGI_DATA_LENGTH"], r.Env["FCGI_DATA_LAST_MOD"], strings.ToUpper(string(r.Data)))
+	})
+	defer srv.Close()
+
+	filename := path.Join(t.TempDir(), "readme.md")
+	if err := os.WriteFile(filename, []byte("# title"), 0o644); err != nil {
+		t.Fatalf("cannot write file : %v", err)
+	}
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatalf("cannot change file time : %v", err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("cannot open file : %v", err)
+	}
+	defer f.Close()
+
+	req, err := FilterFile(Request{Method: "GET", Url: fcgitest.MustUrl(t, "/readme.md"), Index: "filter.php"}, f)
+	if err != nil {
+		t.Fatalf("cannot build filter request : %v", err)
+	}
+	rsp, err := (&Client{Dial: srv.Dial}).Do(req)
+	if err != nil {
+		t.Fatalf("failed running request : %v", err)
+	}
+	if want := "7 1700000000 # TITLE"; rsp.Stdout != want {
+		t.Fatalf("want \n%s\ngot \n%s\n", want, rsp.Stdout)
+	}
+
+	dir, err := os.Open(path.Dir(filename))
+	if err != nil {
+		t.Fatalf("cannot open folder : %v", err)
+	}
+	defer dir.Close()
+	if _, err := FilterFile(req, dir); err == nil {
+		t.Fatalf("want an error filtering a folder")
+	}
+}
@@ -0,0 +1,260 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConns = 8
+	DefaultIdleTimeout  = 30 * time.Second
+)
+
+type DialFunc func() (net.Conn, error)
+
+// Client sends requests to a FastCGI application and keeps up to
+// MaxIdleConns connections open between requests. A zero MaxIdleConns
+// disables pooling and every request gets its own connection.
+//
+// With Multiplex set all requests share a single connection. Once the
+// application answers FCGI_CANT_MPX_CONN that connection is closed when
+// its requests are over, the refused request is sent again and the next
+// ones go through the pool.
+type Client struct {
+	Dial         DialFunc
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+	Multiplex    bool
+	// MaxParamsLen caps the encoded size of the params of a request,
+	// fcgiprotocol.MaxParamsLen when zero. Requests over it fail with a
+	// *fcgiprotocol.PairTooLongError.
+	MaxParamsLen int
+
+	mu    sync.Mutex
+	idle  []idleConn
+	mux   *fcgiprotocol.Conn
+	noMux bool
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func NewClient(network, address string) *Client {
+	return &Client{
+		Dial: func() (net.Conn, error) {
+			return net.Dial(network, address)
+		},
+		MaxIdleConns: DefaultMaxIdleConns,
+		IdleTimeout:  DefaultIdleTimeout,
+	}
+}
+
+func (c *Client) Do(req Request) (Response, error) {
+	return c.DoContext(context.Background(), req)
+}
+
+// DoContext is like Do but aborts the request when ctx is done, see
+// fcgiprotocol.DoContext. Aborted connections are not reused.
+func (c *Client) DoContext(ctx context.Context, req Request) (Response, error) {
+	return readAll(req, func(req Request) (*StreamResponse, error) {
+		return c.Stream(ctx, req)
+	})
+}
+
+// Stream is like the Stream function, the connection goes back to the
+// pool once the response Body is read to the end.
+func (c *Client) Stream(ctx context.Context, req Request) (*StreamResponse, error) {
+	rewind, rewindData := fcgiprotocol.Rewinder(req.Body), fcgiprotocol.Rewinder(req.Data)
+	if mc, err := c.getMuxConn(); err != nil {
+		return nil, err
+	} else if mc != nil {
+		sr, err := c.streamMultiplexed(ctx, mc, req)
+		if !errors.Is(err, fcgiprotocol.ErrCantMultiplex) {
+			return sr, err
+		}
+		// the application refuses a request it cannot multiplex before
+		// running it, the request goes through the pool
+		if rewind == nil || rewindData == nil {
+			return nil, fmt.Errorf("cannot send the request body again : %w", err)
+		}
+		if err := rewind(); err != nil {
+			return nil, err
+		}
+		if err := rewindData(); err != nil {
+			return nil, err
+		}
+	}
+	conn, reused, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	tracked := &trackedConn{Conn: conn}
+	sr, err := stream(ctx, tracked, c.flags(), c.MaxParamsLen, req, c.releaseFunc(conn))
+	if err != nil && reused && !tracked.read.Load() && rewind != nil && rewindData != nil && ctx.Err() == nil && isBrokenConn(err) {
+		// the application may have closed an idle connection on its side,
+		// only the first use tells us so retry once on a fresh one. Once
+		// a response record came the script ran, a worker dying in the
+		// middle of it must not run it twice.
+		if err := rewind(); err != nil {
+			return nil, err
+		}
+		if err := rewindData(); err != nil {
+			return nil, err
+		}
+		conn, err = c.dial()
+		if err != nil {
+			return nil, err
+		}
+		sr, err = stream(ctx, conn, c.flags(), c.MaxParamsLen, req, c.releaseFunc(conn))
+	}
+	return sr, err
+}
+
+func (c *Client) releaseFunc(conn net.Conn) func(reusable bool) {
+	return func(reusable bool) {
+		if !reusable {
+			conn.Close()
+			return
+		}
+		c.putConn(conn)
+	}
+}
+
+func (c *Client) streamMultiplexed(ctx context.Context, mc *fcgiprotocol.Conn, req Request) (*StreamResponse, error) {
+	release := func(bool) {
+		if mc.Err() != nil || !mc.Multiplexing() {
+			c.dropMuxConn(mc, !mc.Multiplexing())
+		}
+	}
+	env, body := buildEnv(req)
+	stderr := &stderrBuffer{next: req.Stderr}
+	rr, err := mc.StreamRole(ctx, req.role(), env, c.MaxParamsLen, body, req.Data, stderr.write)
+	if err != nil {
+		release(false)
+		return nil, fmt.Errorf("cannot send fcgi request: %w", err)
+	}
+	return newStreamResponse(rr, stderr, release)
+}
+
+// getMuxConn returns the shared connection, or nil when requests have to
+// go through the pool.
+func (c *Client) getMuxConn() (*fcgiprotocol.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.Multiplex || c.noMux {
+		return nil, nil
+	}
+	if c.mux != nil && c.mux.Err() == nil {
+		return c.mux, nil
+	}
+	if c.mux != nil {
+		c.mux.Close()
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.mux = fcgiprotocol.NewConn(conn)
+	return c.mux, nil
+}
+
+func (c *Client) dropMuxConn(mc *fcgiprotocol.Conn, cantMultiplex bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cantMultiplex {
+		c.noMux = true
+	}
+	if c.mux == mc {
+		c.mux = nil
+	}
+	mc.CloseWhenIdle()
+}
+
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	if c.mux != nil {
+		c.mux.CloseWhenIdle()
+		c.mux = nil
+	}
+	c.mu.Unlock()
+	for _, ic := range idle {
+		ic.conn.Close()
+	}
+}
+
+func (c *Client) flags() uint8 {
+	if c.MaxIdleConns > 0 {
+		return fcgiprotocol.FCGI_KEEP_CONN
+	}
+	return 0
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial fcgi server : %w", err)
+	}
+	return conn, nil
+}
+
+func (c *Client) getConn() (net.Conn, bool, error) {
+	c.mu.Lock()
+	for len(c.idle) > 0 {
+		last := len(c.idle) - 1
+		ic := c.idle[last]
+		c.idle = c.idle[:last]
+		if c.IdleTimeout > 0 && time.Since(ic.since) > c.IdleTimeout {
+			ic.conn.Close()
+			continue
+		}
+		c.mu.Unlock()
+		return ic.conn, true, nil
+	}
+	c.mu.Unlock()
+	conn, err := c.dial()
+	return conn, false, err
+}
+
+func (c *Client) putConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= c.MaxIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+// trackedConn records whether anything was read from the connection,
+// the response is read while the request is still written.
+type trackedConn struct {
+	net.Conn
+	read atomic.Bool
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.read.Store(true)
+	}
+	return n, err
+}
+
+func isBrokenConn(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
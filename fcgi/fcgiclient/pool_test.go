@@ -0,0 +1,248 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runFakeServer answers every request with a fixed body and closes the
+// connection unless the request asked for FCGI_KEEP_CONN.
+func runFakeServer(t *testing.T) (string, *int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen : %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go serveFake(conn)
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func serveFake(conn net.Conn) {
+	defer conn.Close()
+	w := fcgiprotocol.RawRecordWriter(conn)
+	for {
+		flags := uint8(0)
+		var reqId uint16
+		for {
+			rec := fcgiprotocol.Record{}
+			if err := rec.Read(conn); err != nil {
+				return
+			}
+			if rec.Header.Type == fcgiprotocol.FCGI_BEGIN_REQUEST {
+				flags = rec.Content()[2]
+				reqId = rec.Header.Id
+			}
+			if rec.Header.Type == fcgiprotocol.FCGI_PARAMS && len(rec.Content()) == 0 {
+				break
+			}
+		}
+		w(fcgiprotocol.FCGI_STDOUT, reqId, []byte("Content-type: text/plain\r\n\r\nok"))
+		w(fcgiprotocol.FCGI_END_REQUEST, reqId, make([]byte, 8))
+		if flags&fcgiprotocol.FCGI_KEEP_CONN == 0 {
+			return
+		}
+	}
+}
+
+func TestClientReuseConn(t *testing.T) {
+	tests := map[string]struct {
+		MaxIdleConns int
+		IdleTimeout  time.Duration
+		Wait         time.Duration
+		Dials        int32
+	}{
+		"pool disabled": {
+			MaxIdleConns: 0,
+			Dials:        3,
+		},
+		"pool enabled": {
+			MaxIdleConns: 2,
+			Dials:        1,
+		},
+		"idle timeout expired": {
+			MaxIdleConns: 2,
+			IdleTimeout:  time.Millisecond,
+			Wait:         10 * time.Millisecond,
+			Dials:        3,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr, accepted := runFakeServer(t)
+			c := NewClient("tcp", addr)
+			c.MaxIdleConns = tt.MaxIdleConns
+			c.IdleTimeout = tt.IdleTimeout
+			defer c.CloseIdleConnections()
+			for range 3 {
+				rsp, err := c.Do(Request{
+					Method: "GET",
+					Url:    fcgitest.MustUrl(t, "/"),
+					Index:  "index.php",
+				})
+				if err != nil {
+					t.Fatalf("failed running request : %v", err)
+				}
+				if rsp.Stdout != "ok" {
+					t.Fatalf("want ok got %s", rsp.Stdout)
+				}
+				time.Sleep(tt.Wait)
+			}
+			if got := atomic.LoadInt32(accepted); got != tt.Dials {
+				t.Fatalf("want %d dials got %d", tt.Dials, got)
+			}
+		})
+	}
+}
+
+func TestClientRetryClosedIdleConn(t *testing.T) {
+	addr, accepted := runFakeServer(t)
+	c := NewClient("tcp", addr)
+	defer c.CloseIdleConnections()
+	req := Request{Method: "GET", Url: fcgitest.MustUrl(t, "/"), Index: "index.php"}
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("failed running request : %v", err)
+	}
+
+	// simulate the application closing its side of the idle connection
+	c.mu.Lock()
+	c.idle[0].conn.(*net.TCPConn).CloseRead()
+	c.mu.Unlock()
+
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("failed running request on stale conn : %v", err)
+	}
+	if got := atomic.LoadInt32(accepted); got != 2 {
+		t.Fatalf("want 2 dials got %d", got)
+	}
+}
+
+func TestClientNoRetryAfterResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen : %v", err)
+	}
+	defer l.Close()
+	requests := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				w := fcgiprotocol.RawRecordWriter(conn)
+				for {
+					rec := fcgiprotocol.Record{}
+					if err := rec.Read(conn); err != nil {
+						return
+					}
+					if rec.Header.Type != fcgiprotocol.FCGI_PARAMS || len(rec.Content()) > 0 {
+						continue
+					}
+					w(fcgiprotocol.FCGI_STDOUT, rec.Header.Id, []byte("Content-type: text/plain\r\n"))
+					if atomic.AddInt32(requests, 1) > 1 {
+						// the worker dies in the middle of the script,
+						// before the end of the headers
+						return
+					}
+					w(fcgiprotocol.FCGI_STDOUT, rec.Header.Id, []byte("\r\nok"))
+					w(fcgiprotocol.FCGI_END_REQUEST, rec.Header.Id, make([]byte, 8))
+				}
+			}()
+		}
+	}()
+
+	c := NewClient("tcp", l.Addr().String())
+	defer c.CloseIdleConnections()
+	req := Request{Method: "POST", Url: fcgitest.MustUrl(t, "/"), Index: "index.php", Body: strings.NewReader("body")}
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("failed running request : %v", err)
+	}
+	req.Body = strings.NewReader("body")
+	if _, err := c.Do(req); err == nil {
+		t.Fatalf("want the error of the dead worker")
+	}
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Fatalf("want the script run 2 times got %d", got)
+	}
+}
+
+func TestClientMultiplex(t *testing.T) {
+	addr, accepted := runFakeServer(t)
+	c := NewClient("tcp", addr)
+	c.Multiplex = true
+	defer c.CloseIdleConnections()
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := c.Do(Request{Method: "GET", Url: fcgitest.MustUrl(t, "/"), Index: "index.php"})
+			if err != nil {
+				t.Errorf("failed running request : %v", err)
+				return
+			}
+			if rsp.Stdout != "ok" {
+				t.Errorf("want ok got %s", rsp.Stdout)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(accepted); got != 1 {
+		t.Fatalf("want 1 dial got %d", got)
+	}
+}
+
+func TestClientMultiplexRefused(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, "Content-type: text/plain\r\n\r\n%s", r.Stdin)
+	})
+	defer srv.Close()
+	c := &Client{Dial: srv.Dial, MaxIdleConns: 5, Multiplex: true}
+	defer c.CloseIdleConnections()
+
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf("body %d", i)
+			rsp, err := c.Do(Request{Method: "POST", Url: fcgitest.MustUrl(t, "/"), Index: "index.php", Body: strings.NewReader(body)})
+			if err != nil {
+				t.Errorf("failed running request : %v", err)
+				return
+			}
+			if rsp.Stdout != body {
+				t.Errorf("want %s got %s", body, rsp.Stdout)
+			}
+		}()
+	}
+	wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.noMux || c.mux != nil {
+		t.Fatalf("want the multiplexed connection dropped for the pool")
+	}
+}
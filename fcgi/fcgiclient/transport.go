@@ -0,0 +1,168 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// MaxLocalRedirects stops scripts which keep redirecting to each other.
+const MaxLocalRedirects = 10
+
+// Transport is an http.RoundTripper running requests on a FastCGI
+// application, so that an http.Client can talk to php-fpm directly.
+//
+// Local redirects asked by the script are followed by the Transport as a
+// GET without body, the other responses are returned as they are.
+type Transport struct {
+	Client       *Client
+	DocumentRoot string
+	// Server describes the web server in the environment of the requests.
+	Server ServerInfo
+	// RemoteRoot is given to every request, see Request.RemoteRoot.
+	RemoteRoot string
+	// Index is the script run when SplitPath is nil or does not match.
+	Index string
+	// SplitPath is given to every request, see Request.SplitPath.
+	SplitPath SplitPathFunc
+	// Env is added to the environment of every request, see Request.Env.
+	Env fcgiprotocol.Params
+	// Director can change the FastCGI params of a request right before
+	// they are sent, see Request.EditParams.
+	Director func(r *http.Request, params *fcgiprotocol.Params)
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.Client == nil {
+		closeBody(r)
+		return nil, errors.New("fcgiclient: Transport has no Client")
+	}
+	req, err := t.NewRequest(r)
+	if err != nil {
+		closeBody(r)
+		return nil, err
+	}
+
+	for redirects := 0; ; redirects++ {
+		sr, err := t.Client.Stream(r.Context(), req)
+		if redirects == 0 {
+			closeBody(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sr.LocalRedirect == "" {
+			return sr.HTTPResponse(r), nil
+		}
+		sr.Body.Close()
+		if redirects >= MaxLocalRedirects {
+			return nil, fmt.Errorf("cannot follow local redirect to %s : more than %d redirects", sr.LocalRedirect, MaxLocalRedirects)
+		}
+		target, err := url.Parse(sr.LocalRedirect)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse local redirect %s : %v", sr.LocalRedirect, err)
+		}
+		req = redirect(req, req.Url.ResolveReference(target))
+	}
+}
+
+// NewRequest builds the FastCGI request of r, a body of unknown length is
+// read in memory since php-fpm needs CONTENT_LENGTH to read it.
+func (t *Transport) NewRequest(r *http.Request) (Request, error) {
+	var body io.Reader
+	contentLength := r.ContentLength
+	if r.Body != nil && r.Body != http.NoBody {
+		body = r.Body
+	}
+	if body != nil && contentLength <= 0 {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return Request{}, fmt.Errorf("cannot read request body : %w", err)
+		}
+		body, contentLength = bytes.NewReader(b), int64(len(b))
+	}
+
+	header := r.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if r.Host != "" {
+		header.Set("Host", r.Host)
+	} else if r.URL.Host != "" {
+		header.Set("Host", r.URL.Host)
+	}
+	env := fcgiprotocol.ParamsFromMap(CGIEnv(r, t.Server))
+	env.Override(t.Env)
+
+	req := Request{
+		Method:        r.Method,
+		Url:           r.URL,
+		Body:          body,
+		ContentLength: contentLength,
+		Index:         t.Index,
+		DocumentRoot:  t.DocumentRoot,
+		RemoteRoot:    t.RemoteRoot,
+		SplitPath:     t.SplitPath,
+		Env:           env,
+		Header:        header,
+	}
+	if t.Director != nil {
+		req.EditParams = func(params *fcgiprotocol.Params) {
+			t.Director(r, params)
+		}
+	}
+	return req, nil
+}
+
+// redirect is the GET without body RFC 3875 section 6.2.2 asks to serve
+// for a local redirect, its script is picked again from target.
+func redirect(req Request, target *url.URL) Request {
+	header := req.Header.Clone()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+
+	redirected := req
+	redirected.Method = http.MethodGet
+	redirected.Url = target
+	redirected.Body = nil
+	redirected.ContentLength = 0
+	redirected.Header = header
+	return redirected
+}
+
+// HTTPResponse turns sr into the response to r, the Status header is
+// dropped once applied.
+func (sr *StreamResponse) HTTPResponse(r *http.Request) *http.Response {
+	reason := sr.Reason
+	if reason == "" {
+		reason = http.StatusText(sr.StatusCode)
+	}
+	header := sr.Header.Clone()
+	header.Del("Status")
+	contentLength := int64(-1)
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = cl
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", sr.StatusCode, reason),
+		StatusCode:    sr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          sr.Body,
+		ContentLength: contentLength,
+		Request:       r,
+	}
+}
+
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
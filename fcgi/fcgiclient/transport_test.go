@@ -0,0 +1,168 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		switch r.Env["REQUEST_URI"] {
+		case "/redirect":
+			fmt.Fprint(w, "Location: /target?from=redirect\r\n\r\n")
+			return
+		case "/created":
+			fmt.Fprint(w, "Status: 201 Created\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n")
+			return
+		}
+		fmt.Fprint(w, "Content-type: text/plain\r\n\r\n")
+		for _, key := range []string{
+			"REQUEST_METHOD", "REQUEST_URI", "SCRIPT_FILENAME", "SCRIPT_NAME", "PATH_INFO",
+			"HTTPS", "SERVER_NAME", "SERVER_PORT", "HTTP_HOST", "HTTP_X_TEST", "CONTENT_LENGTH", "APP_ENV",
+		} {
+			fmt.Fprintf(w, "%s=%s\n", key, r.Env[key])
+		}
+		fmt.Fprintf(w, "body=%s", r.Stdin)
+	})
+	defer srv.Close()
+
+	transport := &Transport{
+		Client:       &Client{Dial: srv.Dial},
+		DocumentRoot: "/var/www",
+		Index:        "index.php",
+		SplitPath: func(urlPath string) (string, string, bool) {
+			script, pathInfo, ok := strings.Cut(urlPath, ".php")
+			if !ok {
+				return "", "", false
+			}
+			return script + ".php", pathInfo, true
+		},
+		Env: fcgiprotocol.Params{{Key: "APP_ENV", Value: "test"}},
+	}
+
+	tests := map[string]struct {
+		Method     string
+		Url        string
+		In         io.Reader
+		TLS        bool
+		StatusCode int
+		Status     string
+		Header     http.Header
+		Body       string
+	}{
+		"post with body": {
+			Method:     "POST",
+			Url:        "http://exemple.com/api/users",
+			In:         strings.NewReader("hello"),
+			StatusCode: 200,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body: strings.Join([]string{
+				"REQUEST_METHOD=POST",
+				"REQUEST_URI=/api/users",
+				"SCRIPT_FILENAME=/var/www/index.php",
+				"SCRIPT_NAME=/index.php",
+				"PATH_INFO=",
+				"HTTPS=",
+				"SERVER_NAME=exemple.com",
+				"SERVER_PORT=80",
+				"HTTP_HOST=exemple.com",
+				"HTTP_X_TEST=coucou",
+				"CONTENT_LENGTH=5",
+				"APP_ENV=test",
+				"body=hello",
+			}, "\n"),
+		},
+		"path info over tls": {
+			Method:     "GET",
+			Url:        "https://exemple.com:8443/admin.php/users/1",
+			TLS:        true,
+			StatusCode: 200,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body: strings.Join([]string{
+				"REQUEST_METHOD=GET",
+				"REQUEST_URI=/admin.php/users/1",
+				"SCRIPT_FILENAME=/var/www/admin.php",
+				"SCRIPT_NAME=/admin.php",
+				"PATH_INFO=/users/1",
+				"HTTPS=on",
+				"SERVER_NAME=exemple.com",
+				"SERVER_PORT=8443",
+				"HTTP_HOST=exemple.com:8443",
+				"HTTP_X_TEST=coucou",
+				"CONTENT_LENGTH=0",
+				"APP_ENV=test",
+				"body=",
+			}, "\n"),
+		},
+		"local redirect is followed as a get": {
+			Method:     "POST",
+			Url:        "http://exemple.com/redirect",
+			In:         strings.NewReader("hello"),
+			StatusCode: 200,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body: strings.Join([]string{
+				"REQUEST_METHOD=GET",
+				"REQUEST_URI=/target?from=redirect",
+				"SCRIPT_FILENAME=/var/www/index.php",
+				"SCRIPT_NAME=/index.php",
+				"PATH_INFO=",
+				"HTTPS=",
+				"SERVER_NAME=exemple.com",
+				"SERVER_PORT=80",
+				"HTTP_HOST=exemple.com",
+				"HTTP_X_TEST=coucou",
+				"CONTENT_LENGTH=0",
+				"APP_ENV=test",
+				"body=",
+			}, "\n"),
+		},
+		"status and repeated headers": {
+			Method:     "GET",
+			Url:        "http://exemple.com/created",
+			StatusCode: 201,
+			Status:     "201 Created",
+			Header:     http.Header{"Set-Cookie": {"a=1", "b=2"}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.Method, tt.Url, tt.In)
+			if err != nil {
+				t.Fatalf("cannot build request : %v", err)
+			}
+			req.Header.Set("X-Test", "coucou")
+			if tt.TLS {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rsp, err := (&http.Client{Transport: transport}).Do(req)
+			if err != nil {
+				t.Fatalf("failed running request : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != tt.StatusCode || rsp.Status != tt.Status {
+				t.Fatalf("want status %d '%s' got %d '%s'", tt.StatusCode, tt.Status, rsp.StatusCode, rsp.Status)
+			}
+			if !reflect.DeepEqual(rsp.Header, tt.Header) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Header, rsp.Header)
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package fcgiclient
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Values holds what the application reported about itself, variables
+// it did not report are left to their zero value and missing from Raw.
+type Values struct {
+	MaxConns  int
+	MaxReqs   int
+	MpxsConns bool
+	Raw       map[string]string
+}
+
+func GetValues(rw io.ReadWriter) (Values, error) {
+	raw, err := fcgiprotocol.GetValues(
+		rw,
+		fcgiprotocol.FCGI_MAX_CONNS,
+		fcgiprotocol.FCGI_MAX_REQS,
+		fcgiprotocol.FCGI_MPXS_CONNS,
+	)
+	if err != nil {
+		return Values{}, fmt.Errorf("cannot get fcgi values: %w", err)
+	}
+	return parseValues(raw)
+}
+
+// GetValues uses a connection of its own since the application is free
+// to close it once the management record is answered.
+func (c *Client) GetValues() (Values, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return Values{}, err
+	}
+	defer conn.Close()
+	return GetValues(conn)
+}
+
+func parseValues(raw map[string]string) (Values, error) {
+	v := Values{Raw: raw}
+	var err error
+	if s, ok := raw[fcgiprotocol.FCGI_MAX_CONNS]; ok {
+		v.MaxConns, err = strconv.Atoi(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid %s value '%s' : %w", fcgiprotocol.FCGI_MAX_CONNS, s, err)
+		}
+	}
+	if s, ok := raw[fcgiprotocol.FCGI_MAX_REQS]; ok {
+		v.MaxReqs, err = strconv.Atoi(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid %s value '%s' : %w", fcgiprotocol.FCGI_MAX_REQS, s, err)
+		}
+	}
+	if s, ok := raw[fcgiprotocol.FCGI_MPXS_CONNS]; ok {
+		mpxs, err := strconv.Atoi(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid %s value '%s' : %w", fcgiprotocol.FCGI_MPXS_CONNS, s, err)
+		}
+		v.MpxsConns = mpxs != 0
+	}
+	return v, nil
+}
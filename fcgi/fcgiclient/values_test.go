@@ -0,0 +1,47 @@
+package fcgiclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValues(t *testing.T) {
+	tests := map[string]struct {
+		In       map[string]string
+		Expected Values
+		Error    string
+	}{
+		"all reported": {
+			In: map[string]string{"MAX_CONNS": "10", "MAX_REQS": "50", "MPXS_CONNS": "1"},
+			Expected: Values{
+				MaxConns:  10,
+				MaxReqs:   50,
+				MpxsConns: true,
+				Raw:       map[string]string{"MAX_CONNS": "10", "MAX_REQS": "50", "MPXS_CONNS": "1"},
+			},
+		},
+		"partially reported": {
+			In: map[string]string{"MPXS_CONNS": "0"},
+			Expected: Values{
+				Raw: map[string]string{"MPXS_CONNS": "0"},
+			},
+		},
+		"invalid value": {
+			In:    map[string]string{"MAX_CONNS": "many"},
+			Error: "invalid MAX_CONNS value 'many' : strconv.Atoi: parsing \"many\": invalid syntax",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := parseValues(tt.In)
+			testError(t, err, tt.Error)
+			if tt.Error != "" {
+				return
+			}
+			if !reflect.DeepEqual(tt.Expected, result) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package fcgiprotocol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AbortTimeout is how long the application has to end an aborted request
+// before the connection is torn down. A record being written when the
+// request is aborted gets as long to be finished before the abort record
+// is sent.
+var AbortTimeout = 5 * time.Second
+
+var errAborted = errors.New("fcgi: request aborted")
+
+// DoContext is like DoWithFlags but when ctx is done before the response
+// is over it sends FCGI_ABORT_REQUEST, waits up to AbortTimeout for the
+// application to end the request and then closes rwc.
+func DoContext(ctx context.Context, rwc io.ReadWriteCloser, flags uint8, env Params, body io.Reader) (RawResponse, error) {
+	return readAll(func(stderr func([]byte)) (*ResponseReader, error) {
+		return Stream(ctx, rwc, flags, env, body, stderr)
+	})
+}
+
+// Stream writes the request and returns a reader over its response,
+// stdout is read as it arrives and stderr is given to the stderr
+// callback. ctx is handled the same way as in DoContext until the
+// response is over or closed.
+func Stream(ctx context.Context, rwc io.ReadWriteCloser, flags uint8, env Params, body io.Reader, stderr func([]byte)) (*ResponseReader, error) {
+	return StreamRole(ctx, rwc, FCGI_RESPONDER, flags, env, 0, body, nil, stderr)
+}
+
+// StreamRole is Stream for the given role, data is the FCGI_DATA stream
+// of an FCGI_FILTER request. The params are limited to maxParamsLen,
+// MaxParamsLen when 0.
+func StreamRole(ctx context.Context, rwc io.ReadWriteCloser, role uint8, flags uint8, env Params, maxParamsLen int, body io.Reader, data io.Reader, stderr func([]byte)) (*ResponseReader, error) {
+	var reqId uint16 = 1
+	buf := bufio.NewWriterSize(rwc, MaxWrite)
+	sw := StreamRecordWriter(buf, MaxWrite)
+	a := &abortable{
+		reqId: reqId,
+		w: func(recType uint8, reqId uint16, content []byte) error {
+			if err := sw(recType, reqId, content); err != nil {
+				return err
+			}
+			return buf.Flush()
+		},
+	}
+	// the response is read while the request is written, like the read
+	// loop of a Conn does
+	ahead := readAhead(rwc, reqId)
+	finish, err := a.run(ctx, rwc.Close, func() error {
+		return writeRoleRequest(a.write, reqId, role, flags, env, maxParamsLen, body, data)
+	})
+	if err != nil {
+		ahead.stop()
+		return nil, err
+	}
+	return newResponseReader(
+		ctx,
+		ahead.next,
+		stderr,
+		func(error) {
+			ahead.stop()
+			finish()
+		},
+	), nil
+}
+
+// maxAheadRecords is how many records of a response are read ahead of
+// its reader.
+const maxAheadRecords = 64
+
+// responseAhead reads the records of a response as they come, an
+// application answering before it read the whole body would otherwise
+// block on its writes while the request blocks on its own. It stops
+// after FCGI_END_REQUEST so that a kept connection can carry the next
+// request, and waits for the reader once maxAheadRecords are read.
+type responseAhead struct {
+	records chan Record
+	stopped chan struct{}
+	once    sync.Once
+	// err is set before records is closed
+	err error
+}
+
+func readAhead(r io.Reader, reqId uint16) *responseAhead {
+	ra := &responseAhead{
+		records: make(chan Record, maxAheadRecords),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(ra.records)
+		for {
+			rec := Record{}
+			if err := rec.Read(r); err != nil {
+				ra.err = err
+				return
+			}
+			select {
+			case ra.records <- rec:
+			case <-ra.stopped:
+				ra.err = errResponseClosed
+				return
+			}
+			if rec.Header.Id == reqId && rec.Header.Type == FCGI_END_REQUEST {
+				ra.err = io.EOF
+				return
+			}
+		}
+	}()
+	return ra
+}
+
+func (ra *responseAhead) next(rec *Record) error {
+	read, ok := <-ra.records
+	if !ok {
+		return ra.err
+	}
+	*rec = read
+	return nil
+}
+
+// stop lets the reading go once nobody reads the response anymore, a
+// read in progress ends with the connection.
+func (ra *responseAhead) stop() {
+	ra.once.Do(func() { close(ra.stopped) })
+}
+
+// abortable guards the record writer of a request so that the abort
+// record is only sent once the request began and nothing follows it. The
+// lock is never held while writing, a write stuck on an application which
+// stopped reading must not keep the request from being aborted.
+type abortable struct {
+	mu       sync.Mutex
+	w        recordWriter
+	reqId    uint16
+	begun    bool
+	writing  bool
+	aborted  bool
+	tornDown bool
+	// queued is set when the abort came in the middle of a record, the
+	// abort record is sent once the record is written and then sent is
+	// called.
+	queued bool
+	sent   func()
+}
+
+func (a *abortable) write(recType uint8, reqId uint16, content []byte) error {
+	a.mu.Lock()
+	if a.aborted {
+		a.mu.Unlock()
+		return errAborted
+	}
+	a.writing = true
+	a.mu.Unlock()
+
+	err := a.w(recType, reqId, content)
+
+	a.mu.Lock()
+	a.writing = false
+	if err == nil {
+		a.begun = true
+	}
+	queued, begun := a.queued, a.begun
+	a.queued = false
+	a.mu.Unlock()
+	if queued && begun && a.w(FCGI_ABORT_REQUEST, a.reqId, nil) == nil {
+		a.abortSent()
+	}
+	return err
+}
+
+// abort stops the writes of the request and reports whether the
+// application has to be waited for, that is whether the request had
+// begun. When a record is being written the abort record follows it and
+// sent is called once it is written. An error means the abort record
+// could not be sent and the connection has to be torn down.
+func (a *abortable) abort(sent func()) (bool, error) {
+	a.mu.Lock()
+	begun, writing, aborted := a.begun, a.writing, a.aborted
+	a.aborted = true
+	if !aborted {
+		a.queued, a.sent = writing, sent
+	}
+	a.mu.Unlock()
+	if aborted || !begun && !writing {
+		return false, nil
+	}
+	if writing {
+		return true, nil
+	}
+	if err := a.w(FCGI_ABORT_REQUEST, a.reqId, nil); err != nil {
+		return true, err
+	}
+	a.abortSent()
+	return true, nil
+}
+
+func (a *abortable) abortSent() {
+	if a.sent != nil {
+		a.sent()
+	}
+}
+
+func (a *abortable) tearDown(teardown func() error) {
+	a.mu.Lock()
+	a.tornDown = true
+	a.mu.Unlock()
+	teardown()
+}
+
+// awaitsAnswer reports whether the application got the request and can
+// still end it.
+func (a *abortable) awaitsAnswer() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.begun && !a.tornDown
+}
+
+// run writes the request with write while watching ctx. Once ctx is done
+// the request is aborted and teardown is called if finish is not called
+// within AbortTimeout of the abort record. A record in the middle of
+// being written is finished first, within AbortTimeout too.
+// finish must be called when the response is over.
+func (a *abortable) run(ctx context.Context, teardown func() error, write func() error) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("request aborted : %w", err)
+	}
+	finished := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		// the timer first covers the record in flight and the abort
+		// record, it starts again once the abort record is sent
+		timeout := AbortTimeout
+		timer := time.AfterFunc(timeout, func() {
+			select {
+			case <-finished:
+			default:
+				a.tearDown(teardown)
+			}
+		})
+		wait, err := a.abort(func() { timer.Reset(timeout) })
+		if !wait || err != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			a.tearDown(teardown)
+		}
+	})
+	var once sync.Once
+	finish := func() {
+		once.Do(func() {
+			stop()
+			close(finished)
+		})
+	}
+
+	err := write()
+	if err == nil {
+		return finish, nil
+	}
+	if ctx.Err() == nil {
+		finish()
+		return nil, fmt.Errorf("cant write req : %w", err)
+	}
+	if !a.awaitsAnswer() {
+		finish()
+		return nil, fmt.Errorf("request aborted : %w", ctx.Err())
+	}
+	// the application got the abort request, its answer ends the response
+	return finish, nil
+}
@@ -0,0 +1,251 @@
+package fcgiprotocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// runSlowServer never answers a request on its own, once it receives
+// FCGI_ABORT_REQUEST it ends the request if answerAbort is set.
+func runSlowServer(conn net.Conn, answerAbort bool, aborted chan<- uint16) {
+	go func() {
+		defer conn.Close()
+		for {
+			rec := Record{}
+			if err := rec.Read(conn); err != nil {
+				return
+			}
+			if rec.Header.Type != FCGI_ABORT_REQUEST {
+				continue
+			}
+			aborted <- rec.Header.Id
+			if answerAbort {
+				RawRecordWriter(conn)(FCGI_END_REQUEST, rec.Header.Id, make([]byte, 8))
+			}
+		}
+	}()
+}
+
+func TestDoContextAbort(t *testing.T) {
+	AbortTimeout = 50 * time.Millisecond
+	tests := map[string]struct {
+		Mux         bool
+		AnswerAbort bool
+	}{
+		"single answered":     {Mux: false, AnswerAbort: true},
+		"single torn down":    {Mux: false, AnswerAbort: false},
+		"multiplex answered":  {Mux: true, AnswerAbort: true},
+		"multiplex torn down": {Mux: true, AnswerAbort: false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			aborted := make(chan uint16, 1)
+			runSlowServer(server, tt.AnswerAbort, aborted)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			env := Params{{Key: "SCRIPT_FILENAME", Value: "/slow.php"}}
+			var err error
+			if tt.Mux {
+				c := NewConn(client)
+				_, err = c.DoContext(ctx, env, nil)
+				if tt.AnswerAbort && c.Err() != nil {
+					t.Fatalf("connection should still be usable got %v", c.Err())
+				}
+			} else {
+				_, err = DoContext(ctx, client, 0, env, nil)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("want context deadline exceeded got %v", err)
+			}
+			select {
+			case id := <-aborted:
+				if id != 1 {
+					t.Fatalf("want abort of request 1 got %d", id)
+				}
+			default:
+				t.Fatalf("server did not receive an abort request")
+			}
+		})
+	}
+}
+
+// runStuckServer reads the request up to the end of its params and then
+// stops reading, like a php-fpm pool too busy to read the upload.
+func runStuckServer(conn net.Conn) {
+	go func() {
+		for {
+			rec := Record{}
+			if err := rec.Read(conn); err != nil {
+				return
+			}
+			if rec.Header.Type == FCGI_PARAMS && len(rec.Content()) == 0 {
+				return
+			}
+		}
+	}()
+}
+
+func TestDoContextStuckStdin(t *testing.T) {
+	AbortTimeout = 50 * time.Millisecond
+	for name, mux := range map[string]bool{"single": false, "multiplex": true} {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			runStuckServer(server)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			env := Params{{Key: "SCRIPT_FILENAME", Value: "/upload.php"}}
+			body := bytes.NewReader(make([]byte, 1<<20))
+			returned := make(chan error)
+			go func() {
+				var err error
+				if mux {
+					_, err = NewConn(client).DoContext(ctx, env, body)
+				} else {
+					_, err = DoContext(ctx, client, 0, env, body)
+				}
+				returned <- err
+			}()
+			select {
+			case err := <-returned:
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("want context deadline exceeded got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("request still blocked after its abort timeout")
+			}
+		})
+	}
+}
+
+// runPausedServer stops reading once the params are over and, after
+// pause, reads the rest like runSlowServer answering the abort.
+func runPausedServer(conn net.Conn, pause time.Duration, aborted chan<- uint16) {
+	go func() {
+		for {
+			rec := Record{}
+			if err := rec.Read(conn); err != nil {
+				return
+			}
+			if rec.Header.Type == FCGI_PARAMS && len(rec.Content()) == 0 {
+				break
+			}
+		}
+		time.Sleep(pause)
+		runSlowServer(conn, true, aborted)
+	}()
+}
+
+func TestDoContextAbortWhileWriting(t *testing.T) {
+	AbortTimeout = time.Second
+	for name, mux := range map[string]bool{"single": false, "multiplex": true} {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			aborted := make(chan uint16, 1)
+			runPausedServer(server, 100*time.Millisecond, aborted)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			env := Params{{Key: "SCRIPT_FILENAME", Value: "/upload.php"}}
+			body := bytes.NewReader(make([]byte, 1<<20))
+			var err error
+			if mux {
+				c := NewConn(client)
+				_, err = c.DoContext(ctx, env, body)
+				if c.Err() != nil {
+					t.Fatalf("connection should still be usable got %v", c.Err())
+				}
+			} else {
+				_, err = DoContext(ctx, client, 0, env, body)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("want context deadline exceeded got %v", err)
+			}
+			select {
+			case id := <-aborted:
+				if id != 1 {
+					t.Fatalf("want abort of request 1 got %d", id)
+				}
+			default:
+				t.Fatalf("server did not receive an abort request after the record in flight")
+			}
+		})
+	}
+}
+
+func TestDoContextDoneBeforeBegin(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := DoContext(ctx, client, 0, Params{}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context canceled got %v", err)
+	}
+}
+
+// runEarlyServer answers once the params are over, before it reads the
+// body, and only then reads the rest of the request.
+func runEarlyServer(conn net.Conn, stdout []byte) {
+	go func() {
+		defer conn.Close()
+		for {
+			rec := Record{}
+			if err := rec.Read(conn); err != nil {
+				return
+			}
+			if rec.Header.Type == FCGI_PARAMS && len(rec.Content()) == 0 {
+				break
+			}
+		}
+		// written at once, an empty padding write on a net.Pipe would wait
+		// for a read which never comes
+		rsp := &bytes.Buffer{}
+		w := StreamRecordWriter(rsp, MaxWrite)
+		w(FCGI_STDOUT, 1, stdout)
+		w(FCGI_STDOUT, 1, nil)
+		w(FCGI_END_REQUEST, 1, make([]byte, 8))
+		conn.Write(rsp.Bytes())
+		io.Copy(io.Discard, conn)
+	}()
+}
+
+func TestStreamAnswerBeforeBody(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	stdout := bytes.Repeat([]byte("a"), 1<<20)
+	runEarlyServer(server, stdout)
+
+	env := Params{{Key: "SCRIPT_FILENAME", Value: "/upload.php"}}
+	body := bytes.NewReader(make([]byte, 1<<20))
+	returned := make(chan error)
+	go func() {
+		raw, err := DoContext(context.Background(), client, 0, env, body)
+		if err == nil && !bytes.Equal(raw.Stdout, stdout) {
+			err = fmt.Errorf("unexpected stdout of %d bytes", len(raw.Stdout))
+		}
+		returned <- err
+	}()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("failed running request : %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request and response blocked each other")
+	}
+}
@@ -0,0 +1,310 @@
+package fcgiprotocol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var errConnClosed = errors.New("fcgi: connection closed")
+
+// DefaultMaxQueuedLen is the MaxQueuedLen of a Conn which leaves it at 0.
+const DefaultMaxQueuedLen = 4 << 20
+
+// Conn multiplexes concurrent requests over a single connection to a
+// FastCGI application. Each request gets its own request id, records of
+// concurrent requests are interleaved on the wire and the records read
+// back are routed to the request they belong to using Header.Id.
+//
+// When the application answers FCGI_CANT_MPX_CONN the rejected request
+// fails with ErrCantMultiplex, the Conn takes no more requests and is
+// closed once the requests in flight are over.
+type Conn struct {
+	// MaxQueuedLen is how many bytes of records read for a request can
+	// wait for its reader, a request going over it fails with
+	// ErrQueueFull. 0 means DefaultMaxQueuedLen.
+	MaxQueuedLen int
+
+	rwc io.ReadWriteCloser
+
+	wmu sync.Mutex
+	buf *bufio.Writer
+
+	mu        sync.Mutex
+	pending   map[uint16]*recordQueue
+	lastId    uint16
+	err       error
+	refused   bool
+	closeIdle bool
+}
+
+func NewConn(rwc io.ReadWriteCloser) *Conn {
+	c := &Conn{
+		rwc:     rwc,
+		buf:     bufio.NewWriterSize(rwc, MaxWrite),
+		pending: map[uint16]*recordQueue{},
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *Conn) Do(env Params, body io.Reader) (RawResponse, error) {
+	return c.DoContext(context.Background(), env, body)
+}
+
+// DoContext is like Do but when ctx is done before the response is over
+// it sends FCGI_ABORT_REQUEST for the request, waits up to AbortTimeout
+// for the application to end it and then closes the connection.
+func (c *Conn) DoContext(ctx context.Context, env Params, body io.Reader) (RawResponse, error) {
+	return readAll(func(stderr func([]byte)) (*ResponseReader, error) {
+		return c.Stream(ctx, env, body, stderr)
+	})
+}
+
+// Stream is the multiplexed counterpart of the Stream function. A request
+// rejected with FCGI_CANT_MPX_CONN ends with ErrCantMultiplex, it has to
+// be sent again on another connection.
+func (c *Conn) Stream(ctx context.Context, env Params, body io.Reader, stderr func([]byte)) (*ResponseReader, error) {
+	return c.StreamRole(ctx, FCGI_RESPONDER, env, 0, body, nil, stderr)
+}
+
+// StreamRole is Stream for the given role, data is the FCGI_DATA stream
+// of an FCGI_FILTER request. The params are limited to maxParamsLen,
+// MaxParamsLen when 0.
+func (c *Conn) StreamRole(ctx context.Context, role uint8, env Params, maxParamsLen int, body io.Reader, data io.Reader, stderr func([]byte)) (*ResponseReader, error) {
+	reqId, records, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &abortable{reqId: reqId, w: c.writeRecord}
+	finish, err := a.run(ctx, c.Close, func() error {
+		return writeRoleRequest(a.write, reqId, role, FCGI_KEEP_CONN, env, maxParamsLen, body, data)
+	})
+	if err != nil {
+		c.unregister(reqId)
+		return nil, err
+	}
+	return newResponseReader(ctx, records.next, stderr, func(err error) {
+		if err == errResponseClosed || errors.Is(err, ErrQueueFull) {
+			// nobody reads the response anymore, tell the application
+			// to stop and drop what it still sends
+			a.abort(nil)
+		}
+		if errors.Is(err, ErrCantMultiplex) {
+			c.mu.Lock()
+			c.refused = true
+			c.mu.Unlock()
+		}
+		finish()
+		c.unregister(reqId)
+		if errors.Is(err, ErrCantMultiplex) {
+			c.CloseWhenIdle()
+		}
+	}), nil
+}
+
+// Multiplexing reports whether requests are still sent on the
+// connection, it turns false once the application refused to multiplex.
+func (c *Conn) Multiplexing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.refused
+}
+
+// Err returns the error which made the connection unusable, if any.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) Close() error {
+	return c.rwc.Close()
+}
+
+// CloseWhenIdle closes the connection as soon as no request is in flight.
+func (c *Conn) CloseWhenIdle() {
+	c.mu.Lock()
+	c.closeIdle = true
+	idle := len(c.pending) == 0
+	c.mu.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+// writeRecord writes and flushes a whole record at once so that records
+// of concurrent requests are never mixed up on the wire.
+func (c *Conn) writeRecord(recType uint8, reqId uint16, content []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	err := StreamRecordWriter(c.buf, MaxWrite)(recType, reqId, content)
+	if err == nil {
+		err = c.buf.Flush()
+	}
+	if err != nil {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// register reserves a request id, it fails with ErrCantMultiplex once
+// the application refused to multiplex.
+func (c *Conn) register() (uint16, *recordQueue, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refused {
+		return 0, nil, ErrCantMultiplex
+	}
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	if c.closeIdle {
+		return 0, nil, errConnClosed
+	}
+	for range int(^uint16(0)) {
+		c.lastId++
+		if c.lastId == uint16(FCGI_NULL_REQUEST_ID) {
+			continue
+		}
+		if _, used := c.pending[c.lastId]; used {
+			continue
+		}
+		max := c.MaxQueuedLen
+		if max <= 0 {
+			max = DefaultMaxQueuedLen
+		}
+		records := newRecordQueue(max)
+		c.pending[c.lastId] = records
+		return c.lastId, records, nil
+	}
+	return 0, nil, errors.New("fcgi: no request id available")
+}
+
+func (c *Conn) unregister(reqId uint16) {
+	c.mu.Lock()
+	delete(c.pending, reqId)
+	closeNow := c.closeIdle && len(c.pending) == 0
+	c.mu.Unlock()
+	if closeNow {
+		c.Close()
+	}
+}
+
+func (c *Conn) readLoop() {
+	for {
+		rec := Record{}
+		err := rec.Read(c.rwc)
+		if err != nil {
+			c.mu.Lock()
+			if c.closeIdle && len(c.pending) == 0 {
+				err = errConnClosed
+			}
+			if c.err == nil {
+				c.err = err
+			}
+			for _, records := range c.pending {
+				records.close(err)
+			}
+			c.pending = map[uint16]*recordQueue{}
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Lock()
+		records, ok := c.pending[rec.Header.Id]
+		c.mu.Unlock()
+		if !ok {
+			// management records or records of a request nobody waits for
+			continue
+		}
+		records.push(rec)
+	}
+}
+
+// recordQueue holds the records of one request until they are read, it
+// never blocks the read loop so a slow reader does not hold back the
+// other requests of the connection. Once more than max bytes wait the
+// request fails with ErrQueueFull and its records are dropped.
+type recordQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	records []Record
+	len     int
+	max     int
+	err     error
+}
+
+func newRecordQueue(max int) *recordQueue {
+	q := &recordQueue{max: max}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *recordQueue) push(rec Record) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return
+	}
+	if q.len+len(rec.Buf) > q.max {
+		q.records, q.len = nil, 0
+		q.err = fmt.Errorf("%w : more than %d bytes", ErrQueueFull, q.max)
+		q.cond.Signal()
+		return
+	}
+	q.records = append(q.records, rec)
+	q.len += len(rec.Buf)
+	q.cond.Signal()
+}
+
+func (q *recordQueue) close(err error) {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.cond.Signal()
+	q.mu.Unlock()
+}
+
+func (q *recordQueue) next(rec *Record) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.records) == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if len(q.records) == 0 {
+		return q.err
+	}
+	*rec = q.records[0]
+	q.records = q.records[1:]
+	q.len -= len(rec.Buf)
+	return nil
+}
+
+// Rewinder returns a function bringing body back to where it is now, or
+// nil when body cannot be read again.
+func Rewinder(body io.Reader) func() error {
+	if body == nil {
+		return func() error { return nil }
+	}
+	s, ok := body.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	offset, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	return func() error {
+		_, err := s.Seek(offset, io.SeekStart)
+		return err
+	}
+}
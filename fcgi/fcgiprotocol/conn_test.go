@@ -0,0 +1,181 @@
+package fcgiprotocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runMuxServer answers each request with the value of its NAME param
+// after waiting DELAY milliseconds. When multiplex is false a request
+// received while another one is in flight is rejected with
+// FCGI_CANT_MPX_CONN.
+func runMuxServer(t *testing.T, conn net.Conn, multiplex bool) {
+	t.Helper()
+	var wmu sync.Mutex
+	w := func(recType uint8, reqId uint16, content []byte) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		RawRecordWriter(conn)(recType, reqId, content)
+	}
+	var mu sync.Mutex
+	params := map[uint16][]byte{}
+	inFlight := 0
+	go func() {
+		defer conn.Close()
+		for {
+			rec := Record{}
+			if err := rec.Read(conn); err != nil {
+				return
+			}
+			id := rec.Header.Id
+			switch {
+			case rec.Header.Type == FCGI_BEGIN_REQUEST:
+				mu.Lock()
+				params[id] = []byte{}
+				mu.Unlock()
+			case rec.Header.Type == FCGI_PARAMS && len(rec.Content()) > 0:
+				mu.Lock()
+				params[id] = append(params[id], rec.Content()...)
+				mu.Unlock()
+			case rec.Header.Type == FCGI_PARAMS:
+				mu.Lock()
+				env, _ := decodeEnv(bytes.NewReader(params[id]))
+				delete(params, id)
+				rejected := !multiplex && inFlight > 0
+				if !rejected {
+					inFlight++
+				}
+				mu.Unlock()
+				if rejected {
+					w(FCGI_END_REQUEST, id, []byte{0, 0, 0, 0, FCGI_CANT_MPX_CONN, 0, 0, 0})
+					continue
+				}
+				go func() {
+					var delay int
+					fmt.Sscanf(env.Get("DELAY"), "%d", &delay)
+					time.Sleep(time.Duration(delay) * time.Millisecond)
+					w(FCGI_STDOUT, id, []byte(env.Get("NAME")))
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+					w(FCGI_END_REQUEST, id, make([]byte, 8))
+				}()
+			}
+		}
+	}()
+}
+
+func TestConnDo(t *testing.T) {
+	tests := map[string]struct {
+		Multiplex    bool
+		Multiplexing bool
+	}{
+		"multiplexed": {
+			Multiplex:    true,
+			Multiplexing: true,
+		},
+		"refused": {
+			Multiplex:    false,
+			Multiplexing: false,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			runMuxServer(t, server, tt.Multiplex)
+			c := NewConn(client)
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			results := make([]string, 10)
+			errs := make([]error, 10)
+			for i := range results {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rr, err := c.Do(Params{
+						{Key: "NAME", Value: fmt.Sprintf("req-%d", i)},
+						{Key: "DELAY", Value: fmt.Sprintf("%d", (10-i)*5)},
+					}, nil)
+					results[i] = string(rr.Stdout)
+					errs[i] = err
+				}()
+			}
+			wg.Wait()
+
+			refused := 0
+			for i := range results {
+				if !tt.Multiplex && errors.Is(errs[i], ErrCantMultiplex) {
+					refused++
+					continue
+				}
+				if errs[i] != nil {
+					t.Fatalf("request %d failed : %v", i, errs[i])
+				}
+				if want := fmt.Sprintf("req-%d", i); results[i] != want {
+					t.Fatalf("request %d want %s got %s", i, want, results[i])
+				}
+			}
+			if !tt.Multiplex && refused == 0 {
+				t.Fatalf("want requests refused with %v", ErrCantMultiplex)
+			}
+			if c.Multiplexing() != tt.Multiplexing {
+				t.Fatalf("want multiplexing %v got %v", tt.Multiplexing, c.Multiplexing())
+			}
+		})
+	}
+}
+
+func TestConnClosedByServer(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		rec := Record{}
+		rec.Read(server)
+		server.Close()
+	}()
+	c := NewConn(client)
+	defer c.Close()
+	_, err := c.Do(Params{}, nil)
+	if err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if c.Err() == nil {
+		t.Fatalf("expected connection to be marked as broken")
+	}
+}
+
+func TestConnQueueFull(t *testing.T) {
+	client, server := net.Pipe()
+	runMuxServer(t, server, true)
+	c := NewConn(client)
+	c.MaxQueuedLen = 64
+	defer c.Close()
+
+	// nobody reads the first response while the second one goes through
+	big := strings.Repeat("x", 100)
+	rr, err := c.Stream(context.Background(), Params{{Key: "NAME", Value: big}}, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot send the request : %v", err)
+	}
+	raw, err := c.Do(Params{{Key: "NAME", Value: "small"}, {Key: "DELAY", Value: "10"}}, nil)
+	if err != nil {
+		t.Fatalf("second request failed : %v", err)
+	}
+	if string(raw.Stdout) != "small" {
+		t.Fatalf("want small got %s", raw.Stdout)
+	}
+
+	_, err = io.ReadAll(rr)
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("want %v got %v", ErrQueueFull, err)
+	}
+}
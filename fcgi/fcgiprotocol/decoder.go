@@ -1,23 +1,37 @@
 package fcgiprotocol
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net/http"
 	"strconv"
 	"strings"
 )
 
 type Request struct {
 	ReqId uint16
-	Env   map[string]string
+	// Role and Flags are the body of FCGI_BEGIN_REQUEST.
+	Role  uint16
+	Flags uint8
+	Env   Params
 	Stdin []byte
+	// Data is the FCGI_DATA stream of an FCGI_FILTER request.
+	Data []byte
 }
 
+// DecodeRequest decodes the request started by the first record of input,
+// which must be FCGI_BEGIN_REQUEST. Records with another request id are
+// skipped, so input can hold the whole traffic of a multiplexed
+// connection.
 func DecodeRequest(input []Record) (Request, error) {
 	decoded := Request{}
 	var err error
+	if len(input) == 0 {
+		return Request{}, fmt.Errorf("request should start with packet 'begin' got nothing")
+	}
 	if input[0].Header.Type != FCGI_BEGIN_REQUEST {
 		return Request{}, fmt.Errorf(
 			"request should start with packet 'begin' got %v",
@@ -25,13 +39,25 @@ func DecodeRequest(input []Record) (Request, error) {
 		)
 	}
 	decoded.ReqId = input[0].Header.Id
+	if begin := input[0].Content(); len(begin) >= 3 {
+		decoded.Role = binary.BigEndian.Uint16(begin[0:2])
+		decoded.Flags = begin[2]
+	}
 	envContent := []byte{}
 	for _, r := range input[1:] {
+		if r.Header.Id != decoded.ReqId {
+			continue
+		}
 		switch r.Header.Type {
 		case FCGI_PARAMS:
 			envContent = append(envContent, r.Content()...)
+			if len(envContent) > MaxParamsLen {
+				return decoded, &PairTooLongError{Field: "params", Len: len(envContent), Max: MaxParamsLen}
+			}
 		case FCGI_STDIN:
 			decoded.Stdin = append(decoded.Stdin, r.Content()...)
+		case FCGI_DATA:
+			decoded.Data = append(decoded.Data, r.Content()...)
 		}
 	}
 	decoded.Env, err = decodeEnv(bytes.NewReader(envContent))
@@ -41,105 +67,157 @@ func DecodeRequest(input []Record) (Request, error) {
 	return decoded, nil
 }
 
-func decodeEnv(r io.Reader) (map[string]string, error) {
-	pairs := make(map[string]string)
-	b := make([]byte, 4)
-
+func decodeEnv(r io.Reader) (Params, error) {
+	pairs := Params{}
+	pr := NewPairReader(r)
 	for {
-		// Read the key length
-		n, err := r.Read(b[:1])
-		if err != nil {
-			if err == io.EOF && n == 0 {
-				break
-			}
-			return nil, err
-		}
-
-		var keyLen uint32
-		if b[0] > 127 {
-			// Key length is encoded in 4 bytes
-			if _, err := io.ReadFull(r, b[1:4]); err != nil {
-				return nil, err
-			}
-			binary.BigEndian.PutUint32(b[:4], binary.BigEndian.Uint32(b[:4])&^(1<<31))
-			keyLen = binary.BigEndian.Uint32(b[:4])
-		} else {
-			// Key length is encoded in 1 byte
-			keyLen = uint32(b[0])
-		}
-
-		// Read the value length
-		if _, err := io.ReadFull(r, b[:1]); err != nil {
-			return nil, err
+		pair, err := pr.Next()
+		if err == io.EOF {
+			return pairs, nil
 		}
-
-		var valueLen uint32
-		if b[0] > 127 {
-			// Value length is encoded in 4 bytes
-			if _, err := io.ReadFull(r, b[1:4]); err != nil {
-				return nil, err
-			}
-			binary.BigEndian.PutUint32(b[:4], binary.BigEndian.Uint32(b[:4])&^(1<<31))
-			valueLen = binary.BigEndian.Uint32(b[:4])
-		} else {
-			// Value length is encoded in 1 byte
-			valueLen = uint32(b[0])
-		}
-
-		// Read the key
-		key := make([]byte, keyLen)
-		if _, err := io.ReadFull(r, key); err != nil {
-			return nil, err
-		}
-
-		// Read the value
-		value := make([]byte, valueLen)
-		if _, err := io.ReadFull(r, value); err != nil {
+		if err != nil {
 			return nil, err
 		}
-
-		pairs[string(key)] = string(value)
+		pairs = append(pairs, pair)
 	}
-
-	return pairs, nil
 }
 
 type Response struct {
 	StatusCode int
-	Headers    map[string]string
-	Stdout     string
+	// Reason is the reason phrase given with the Status header, if any.
+	Reason  string
+	Headers http.Header
+	Stdout  string
+	// LocalRedirect is the path the script asked the server to serve
+	// instead, set when Location holds a local path and no Status is
+	// given (RFC 3875 section 6.2.2).
+	LocalRedirect string
 }
 
-func ParseResponse(content string) (Response, error) {
+// MalformedHeaderError is returned when a line of the header block of a
+// response is not a valid CGI header field.
+type MalformedHeaderError struct {
+	Line   string
+	Reason string
+}
+
+func (e *MalformedHeaderError) Error() string {
+	return fmt.Sprintf("malformed response header line %q : %s", e.Line, e.Reason)
+}
 
-	parts := strings.SplitN(content, "\r\n\r\n", 2)
+// ParseResponse parses a whole response, the header block may end with
+// either "\r\n\r\n" or "\n\n".
+func ParseResponse(content string) (Response, error) {
+	r := bufio.NewReader(strings.NewReader(content))
+	rsp, err := ReadResponseHeader(r)
+	if err != nil {
+		return rsp, err
+	}
+	stdout, _ := io.ReadAll(r)
+	rsp.Stdout = string(stdout)
+	return rsp, nil
+}
 
-	if len(parts) < 2 {
-		return Response{StatusCode: 502}, fmt.Errorf("cannot parse response, content must have 2 part got %v", len(parts))
+// ReadResponseHeader reads the header block of a response from r, what
+// remains in r is the body. Stdout is left empty.
+func ReadResponseHeader(r *bufio.Reader) (Response, error) {
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Response{StatusCode: 502}, fmt.Errorf("cannot parse response, header block is not terminated : %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
 	}
+	return parseHeaderLines(lines)
+}
 
+// parseHeaderLines applies RFC 3875 section 6: the status comes from the
+// Status header, a Location without Status is either a local redirect or
+// a 302 client redirect.
+func parseHeaderLines(lines []string) (Response, error) {
+	headers, err := parseHeaderFields(lines)
+	if err != nil {
+		return Response{StatusCode: 502}, err
+	}
 	rsp := Response{
 		StatusCode: 200,
-		Headers:    ParseHeader(parts[0]),
-		Stdout:     parts[1],
+		Headers:    headers,
+	}
+
+	if st := headers.Get("Status"); st != "" {
+		rsp.StatusCode, rsp.Reason, err = parseStatus(st)
+		if err != nil {
+			return Response{StatusCode: 502}, err
+		}
+		return rsp, nil
 	}
 
-	if st, ok := rsp.Headers["Status"]; ok {
-		rsp.StatusCode, _ = strconv.Atoi(st[0:3])
+	if location := headers.Get("Location"); location != "" {
+		if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+			rsp.LocalRedirect = location
+		} else {
+			rsp.StatusCode = 302
+		}
 	}
 
 	return rsp, nil
 }
 
-func ParseHeader(content string) map[string]string {
-	headers := map[string]string{}
-	headerParts := strings.Split(content, "\r\n")
-	for _, line := range headerParts {
-		lineParts := strings.SplitN(line, ":", 2)
-		if len(lineParts) < 2 {
-			continue
+func parseStatus(st string) (int, string, error) {
+	code, reason, _ := strings.Cut(st, " ")
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || statusCode < 100 {
+		return 0, "", &MalformedHeaderError{Line: "Status: " + st, Reason: "status must start with a 3 digit code"}
+	}
+	return statusCode, strings.TrimSpace(reason), nil
+}
+
+// ParseHeader keeps every header line, a header sent several times like
+// Set-Cookie gets one value per line. Lines may end with "\r\n" or "\n".
+func ParseHeader(content string) (http.Header, error) {
+	lines := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return parseHeaderFields(lines)
+}
+
+func parseHeaderFields(lines []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, &MalformedHeaderError{Line: line, Reason: "missing colon"}
+		}
+		if !isToken(name) {
+			return nil, &MalformedHeaderError{Line: line, Reason: "invalid field name"}
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// isToken reports whether name is a token as defined by RFC 3875 section
+// 2.2, which is what a header field name must be.
+func isToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("()<>@,;:\\\"/[]?={}", c) >= 0 {
+			return false
 		}
-		headers[lineParts[0]] = strings.TrimSpace(lineParts[1])
 	}
-	return headers
+	return true
 }
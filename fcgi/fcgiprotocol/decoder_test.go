@@ -3,6 +3,7 @@ package fcgiprotocol
 import (
 	"bytes"
 	"encoding/base64"
+	"net/http"
 	"reflect"
 	"strings"
 	"testing"
@@ -11,23 +12,36 @@ import (
 // Assume writePairs and readPairs are in the same package or imported accordingly
 func TestDecodeEnv(t *testing.T) {
 	tests := map[string]struct {
-		Data map[string]string
+		Data Params
 	}{
 		"simple case": {
-			Data: map[string]string{
-				"key1": "value1",
-				"key2": "value2",
-				"key3": "value3",
+			Data: Params{
+				{Key: "key1", Value: "value1"},
+				{Key: "key2", Value: "value2"},
+				{Key: "key3", Value: "value3"},
 			},
 		},
 		"empty case": {
-			Data: map[string]string{},
+			Data: Params{},
 		},
 		"complex case": {
-			Data: map[string]string{
-				"key1":           "value1",
-				"longkey2":       "longvalue2",
-				"key with space": "value with space",
+			Data: Params{
+				{Key: "key1", Value: "value1"},
+				{Key: "longkey2", Value: "longvalue2"},
+				{Key: "key with space", Value: "value with space"},
+			},
+		},
+		"wire order and duplicates": {
+			Data: Params{
+				{Key: "SCRIPT_NAME", Value: "/index.php"},
+				{Key: "HTTP_X", Value: "1"},
+				{Key: "CONTENT_LENGTH", Value: "0"},
+				{Key: "HTTP_X", Value: "2"},
+			},
+		},
+		"binary": {
+			Data: Params{
+				{Key: "BIN\x00", Value: "\xff\x00\r\n"},
 			},
 		},
 	}
@@ -73,11 +87,12 @@ func TestParseResponse(t *testing.T) {
 			},
 			Out: Response{
 				StatusCode: 412,
-				Headers: map[string]string{
-					"Status":        "412 Precondition Failed",
-					"Status-Code":   "412",
-					"X-Status-Code": "412",
-					"Content-type":  "text/html; charset=UTF-8",
+				Reason:     "Precondition Failed",
+				Headers: http.Header{
+					"Status":        {"412 Precondition Failed"},
+					"Status-Code":   {"412"},
+					"X-Status-Code": {"412"},
+					"Content-Type":  {"text/html; charset=UTF-8"},
 				},
 				Stdout: strings.Join([]string{
 					"<h1>Requested URL:</h1><p>/test</p><h1>Request Method:</h1><p>GET</p><h1>Headers:</h1><pre>Accept: */*",
@@ -106,21 +121,21 @@ func TestParseResponse(t *testing.T) {
 			},
 			Out: Response{
 				StatusCode: 200,
-				Headers: map[string]string{
-					"X-Powered-By":                     "PHP/8.3.8",
-					"Cache-Control":                    "max-age=0, must-revalidate, private",
-					"Date":                             "Wed, 19 Jun 2024 07:21:11 GMT",
-					"Vary":                             "Origin",
-					"Access-Control-Allow-Credentials": "true",
-					"Access-Control-Allow-Methods":     "POST, PUT, PATCH, GET, DELETE",
-					"Access-Control-Allow-Headers":     "content-type",
-					"Access-Control-Max-Age":           "3600",
-					"Access-Control-Allow-Origin":      "https://verification.exemple.com",
-					"Content-Security-Policy":          "default-src 'none'; frame-ancestors 'none'",
-					"Strict-Transport-Security":        "max-age=63072000",
-					"X-Content-Type-Options":           "nosniff",
-					"Content-Type":                     "text/html; charset=UTF-8",
-					"Expires":                          "Wed, 19 Jun 2024 07:21:11 GMT",
+				Headers: http.Header{
+					"X-Powered-By":                     {"PHP/8.3.8"},
+					"Cache-Control":                    {"max-age=0, must-revalidate, private"},
+					"Date":                             {"Wed, 19 Jun 2024 07:21:11 GMT"},
+					"Vary":                             {"Origin"},
+					"Access-Control-Allow-Credentials": {"true"},
+					"Access-Control-Allow-Methods":     {"POST, PUT, PATCH, GET, DELETE"},
+					"Access-Control-Allow-Headers":     {"content-type"},
+					"Access-Control-Max-Age":           {"3600"},
+					"Access-Control-Allow-Origin":      {"https://verification.exemple.com"},
+					"Content-Security-Policy":          {"default-src 'none'; frame-ancestors 'none'"},
+					"Strict-Transport-Security":        {"max-age=63072000"},
+					"X-Content-Type-Options":           {"nosniff"},
+					"Content-Type":                     {"text/html; charset=UTF-8"},
+					"Expires":                          {"Wed, 19 Jun 2024 07:21:11 GMT"},
 				},
 				Stdout: "\x00\x00\x00\x00",
 			},
@@ -143,3 +158,179 @@ func TestParseResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestParseResponseCGI(t *testing.T) {
+	tests := map[string]struct {
+		In    string
+		Out   Response
+		Error error
+	}{
+		"bare newline separators": {
+			In: "Content-Type: text/plain\nStatus: 404\n\nnot found",
+			Out: Response{
+				StatusCode: 404,
+				Headers: http.Header{
+					"Content-Type": {"text/plain"},
+					"Status":       {"404"},
+				},
+				Stdout: "not found",
+			},
+		},
+		"reason phrase is kept": {
+			In: "Status: 418 I'm a teapot\r\n\r\n",
+			Out: Response{
+				StatusCode: 418,
+				Reason:     "I'm a teapot",
+				Headers:    http.Header{"Status": {"418 I'm a teapot"}},
+			},
+		},
+		"local redirect": {
+			In: "Location: /other?page=2\n\n",
+			Out: Response{
+				StatusCode:    200,
+				Headers:       http.Header{"Location": {"/other?page=2"}},
+				LocalRedirect: "/other?page=2",
+			},
+		},
+		"client redirect": {
+			In: "Location: https://exemple.com/\r\n\r\n",
+			Out: Response{
+				StatusCode: 302,
+				Headers:    http.Header{"Location": {"https://exemple.com/"}},
+			},
+		},
+		"redirect with status is a client redirect": {
+			In: "Status: 301 Moved Permanently\r\nLocation: /other\r\n\r\n",
+			Out: Response{
+				StatusCode: 301,
+				Reason:     "Moved Permanently",
+				Headers: http.Header{
+					"Status":   {"301 Moved Permanently"},
+					"Location": {"/other"},
+				},
+			},
+		},
+		"line without colon": {
+			In:    "Content-Type: text/plain\r\ngarbage\r\n\r\n",
+			Out:   Response{StatusCode: 502},
+			Error: &MalformedHeaderError{Line: "garbage", Reason: "missing colon"},
+		},
+		"invalid field name": {
+			In:    "Content Type: text/plain\r\n\r\n",
+			Out:   Response{StatusCode: 502},
+			Error: &MalformedHeaderError{Line: "Content Type: text/plain", Reason: "invalid field name"},
+		},
+		"invalid status": {
+			In:    "Status: ok\r\n\r\n",
+			Out:   Response{StatusCode: 502},
+			Error: &MalformedHeaderError{Line: "Status: ok", Reason: "status must start with a 3 digit code"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := ParseResponse(tt.In)
+			if !reflect.DeepEqual(err, tt.Error) {
+				t.Fatalf("\ngot error  %#v \nwant error %#v\n", err, tt.Error)
+			}
+			if !reflect.DeepEqual(result, tt.Out) {
+				t.Fatalf("\ngot  %#v \nwant %#v\n", result, tt.Out)
+			}
+		})
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := map[string]struct {
+		In  string
+		Out http.Header
+	}{
+		"repeated header": {
+			In: "Set-Cookie: a=1; path=/\r\nSet-Cookie: b=2\r\nVary: Origin\r\nvary: Accept-Encoding",
+			Out: http.Header{
+				"Set-Cookie": {"a=1; path=/", "b=2"},
+				"Vary":       {"Origin", "Accept-Encoding"},
+			},
+		},
+		"bare newlines": {
+			In: "Link: </style.css>; rel=preload\nLink: </app.js>; rel=preload\n",
+			Out: http.Header{
+				"Link": {"</style.css>; rel=preload", "</app.js>; rel=preload"},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := ParseHeader(tt.In)
+			if err != nil {
+				t.Fatalf("failed parsing header : %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.Out) {
+				t.Fatalf("\ngot  %#v \nwant %#v\n", result, tt.Out)
+			}
+		})
+	}
+}
+
+func TestDecodeRequestInterleaved(t *testing.T) {
+	readRecords := func(reqId uint16, env Params, body string) []Record {
+		buf := &bytes.Buffer{}
+		err := WriteRequest(RawRecordWriter(buf), reqId, FCGI_KEEP_CONN, env, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed writing request : %v", err)
+		}
+		records := []Record{}
+		for {
+			rec := Record{}
+			if err := rec.Read(buf); err != nil {
+				return records
+			}
+			records = append(records, rec)
+		}
+	}
+	first := readRecords(1, Params{{Key: "REQUEST_URI", Value: "/first"}}, "one")
+	second := readRecords(2, Params{{Key: "REQUEST_URI", Value: "/second"}}, "two")
+	interleaved := []Record{}
+	for i := range first {
+		interleaved = append(interleaved, first[i], second[i])
+	}
+
+	tests := map[string]struct {
+		In       []Record
+		Expected Request
+	}{
+		"first": {
+			In: interleaved,
+			Expected: Request{
+				ReqId: 1,
+				Role:  uint16(FCGI_RESPONDER),
+				Flags: FCGI_KEEP_CONN,
+				Env:   Params{{Key: "REQUEST_URI", Value: "/first"}},
+				Stdin: []byte("one"),
+			},
+		},
+		"second": {
+			In: interleaved[1:],
+			Expected: Request{
+				ReqId: 2,
+				Role:  uint16(FCGI_RESPONDER),
+				Flags: FCGI_KEEP_CONN,
+				Env:   Params{{Key: "REQUEST_URI", Value: "/second"}},
+				Stdin: []byte("two"),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := DecodeRequest(tt.In)
+			if err != nil {
+				t.Fatalf("failed decoding request : %v", err)
+			}
+			if !reflect.DeepEqual(tt.Expected, decoded) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, decoded)
+			}
+		})
+	}
+}
@@ -52,6 +52,10 @@ const (
 	MaxPad     = int(^uint8(0))
 )
 
+// MaxParamsLen is the default cap of the encoded size of the params of a
+// request, they are split across as many FCGI_PARAMS records as needed.
+const MaxParamsLen = 1 << 20
+
 type Header struct {
 	Version       uint8
 	Type          uint8
@@ -81,7 +85,7 @@ func (rec *Record) Read(r io.Reader) (err error) {
 		return err
 	}
 	if rec.Header.Version != VERSION_1 {
-		return errors.New("fcgi: invalid header version")
+		return ErrInvalidVersion
 	}
 	n := int(rec.Header.ContentLength) + int(rec.Header.PaddingLength)
 	if n > MaxWrite+MaxPad {
@@ -0,0 +1,71 @@
+package fcgiprotocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCantMultiplex is the FCGI_CANT_MPX_CONN protocol status.
+	ErrCantMultiplex = errors.New("fcgi: application cannot multiplex connections")
+	// ErrOverloaded is the FCGI_OVERLOADED protocol status, the
+	// application is out of workers.
+	ErrOverloaded = errors.New("fcgi: application is overloaded")
+	// ErrUnknownRole is the FCGI_UNKNOWN_ROLE protocol status.
+	ErrUnknownRole = errors.New("fcgi: application does not handle the role")
+	// ErrInvalidVersion is returned for a record which is not FastCGI 1.
+	ErrInvalidVersion = errors.New("fcgi: invalid header version")
+	// ErrMissingEndRequest is returned when the connection ends before
+	// the FCGI_END_REQUEST of the response.
+	ErrMissingEndRequest = errors.New("fcgi: connection closed before the end of the request")
+	// ErrTruncatedEndRequest is returned for an FCGI_END_REQUEST with
+	// less than 8 bytes of content.
+	ErrTruncatedEndRequest = errors.New("fcgi: truncated end request record")
+	// ErrTruncatedPair is returned when the input ends in the middle of
+	// a name-value pair.
+	ErrTruncatedPair = errors.New("fcgi: truncated name-value pair")
+	// ErrQueueFull is returned when the response of a multiplexed request
+	// piles up faster than it is read.
+	ErrQueueFull = errors.New("fcgi: response not read fast enough")
+)
+
+// PairTooLongError is returned when a key, a value or the whole params
+// are over the limits of a PairReader, or when the params of a request
+// to write are over its limit.
+type PairTooLongError struct {
+	// Field is key, value or params.
+	Field string
+	Len   int
+	Max   int
+}
+
+func (e *PairTooLongError) Error() string {
+	return fmt.Sprintf("fcgi: %s len %d exceed max of (%d)", e.Field, e.Len, e.Max)
+}
+
+// AppError is returned when the application ended a request with a non
+// zero app status, a php fatal error for instance.
+type AppError struct {
+	AppStatus uint32
+	Stderr    []byte
+}
+
+func (e *AppError) Error() string {
+	return fmt.Sprintf("fcgi: application exited with status %d : stderr '%s'", e.AppStatus, e.Stderr)
+}
+
+// protocolStatusError returns the error of the protocol status of an
+// FCGI_END_REQUEST, nil for FCGI_REQUEST_COMPLETE.
+func protocolStatusError(status uint8) error {
+	switch status {
+	case FCGI_REQUEST_COMPLETE:
+		return nil
+	case FCGI_CANT_MPX_CONN:
+		return ErrCantMultiplex
+	case FCGI_OVERLOADED:
+		return ErrOverloaded
+	case FCGI_UNKNOWN_ROLE:
+		return ErrUnknownRole
+	}
+	return fmt.Errorf("fcgi: unknown protocol status %d", status)
+}
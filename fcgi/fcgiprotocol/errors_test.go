@@ -0,0 +1,62 @@
+package fcgiprotocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestResponseReaderErrors(t *testing.T) {
+	endRequest := func(protocolStatus uint8) []byte {
+		buf := &bytes.Buffer{}
+		RawRecordWriter(buf)(FCGI_STDOUT, 1, []byte("Content-type: text/plain\r\n\r\n"))
+		RawRecordWriter(buf)(FCGI_END_REQUEST, 1, []byte{0, 0, 0, 0, protocolStatus, 0, 0, 0})
+		return buf.Bytes()
+	}
+	tests := map[string]struct {
+		In    []byte
+		Error error
+	}{
+		"request complete": {
+			In:    endRequest(FCGI_REQUEST_COMPLETE),
+			Error: nil,
+		},
+		"cannot multiplex": {
+			In:    endRequest(FCGI_CANT_MPX_CONN),
+			Error: ErrCantMultiplex,
+		},
+		"overloaded": {
+			In:    endRequest(FCGI_OVERLOADED),
+			Error: ErrOverloaded,
+		},
+		"unknown role": {
+			In:    endRequest(FCGI_UNKNOWN_ROLE),
+			Error: ErrUnknownRole,
+		},
+		"missing end request": {
+			In:    endRequest(FCGI_REQUEST_COMPLETE)[:8+32],
+			Error: ErrMissingEndRequest,
+		},
+		"truncated end request": {
+			In:    append(endRequest(FCGI_REQUEST_COMPLETE)[:8+32], 1, FCGI_END_REQUEST, 0, 1, 0, 2, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0),
+			Error: ErrTruncatedEndRequest,
+		},
+		"invalid version": {
+			In:    append([]byte{2}, endRequest(FCGI_REQUEST_COMPLETE)[1:]...),
+			Error: ErrInvalidVersion,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := io.ReadAll(NewResponseReader(bytes.NewReader(tt.In), nil))
+			if tt.Error == nil && err != nil {
+				t.Fatalf("failed reading response : %v", err)
+			}
+			if !errors.Is(err, tt.Error) {
+				t.Fatalf("want error %v got %v", tt.Error, err)
+			}
+		})
+	}
+}
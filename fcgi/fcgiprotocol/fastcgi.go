@@ -14,44 +14,79 @@ var pad [MaxPad]byte
 
 type recordWriter func(recType uint8, reqId uint16, content []byte) error
 
-func Do(rwc io.ReadWriter, env map[string]string, reqStr string) (RawResponse, error) {
-	var reqId uint16 = 1
-	buf := bufio.NewWriterSize(rwc, MaxWrite)
-	err := WriteRequest(StreamRecordWriter(buf, MaxWrite), reqId, env, reqStr)
-	if err != nil {
-		return RawResponse{}, fmt.Errorf("cant write req : %w", err)
-	}
-	err = buf.Flush()
-	if err != nil {
-		return RawResponse{}, fmt.Errorf("while flushing, cant write req %w", err)
-	}
+func Do(rwc io.ReadWriter, env Params, body io.Reader) (RawResponse, error) {
+	return DoWithFlags(rwc, 0, env, body)
+}
+
+// DoWithFlags is like Do but sends flags in the begin request body.
+// With FCGI_KEEP_CONN the application leaves the connection open once
+// the request is over so it can carry the next one.
+func DoWithFlags(rwc io.ReadWriter, flags uint8, env Params, body io.Reader) (RawResponse, error) {
+	return readAll(func(stderr func([]byte)) (*ResponseReader, error) {
+		var reqId uint16 = 1
+		buf := bufio.NewWriterSize(rwc, MaxWrite)
+		err := WriteRequest(StreamRecordWriter(buf, MaxWrite), reqId, flags, env, body)
+		if err != nil {
+			return nil, fmt.Errorf("cant write req : %w", err)
+		}
+		err = buf.Flush()
+		if err != nil {
+			return nil, fmt.Errorf("while flushing, cant write req %w", err)
+		}
+		return NewResponseReader(rwc, stderr), nil
+	})
+}
 
-	return readResponse(rwc)
+// WriteRequest writes a whole FCGI_RESPONDER request, body is sent as
+// FCGI_STDIN records while it is read and a nil body is an empty one.
+// The params are limited to MaxParamsLen.
+func WriteRequest(w recordWriter, reqId uint16, flags uint8, env Params, body io.Reader) error {
+	return WriteRoleRequest(w, reqId, FCGI_RESPONDER, flags, env, body, nil)
 }
 
-func WriteRequest(w recordWriter, reqId uint16, env map[string]string, body string) error {
-	buf := &bytes.Buffer{}
-	err := BuildPair(buf, env)
-	if err != nil {
-		return fmt.Errorf("cant build pair : %w", err)
+// WriteRoleRequest is WriteRequest for the given role, FCGI_AUTHORIZER
+// requests are sent with a nil body. The FCGI_DATA stream of an
+// FCGI_FILTER request is read from data after stdin, it is not sent for
+// the other roles.
+func WriteRoleRequest(w recordWriter, reqId uint16, role uint8, flags uint8, env Params, body io.Reader, data io.Reader) error {
+	return writeRoleRequest(w, reqId, role, flags, env, 0, body, data)
+}
+
+// writeRoleRequest is WriteRoleRequest with the params limited to
+// maxParamsLen, MaxParamsLen when 0. Params over it fail with a
+// *PairTooLongError before anything is written.
+func writeRoleRequest(w recordWriter, reqId uint16, role uint8, flags uint8, env Params, maxParamsLen int, body io.Reader, data io.Reader) error {
+	if maxParamsLen <= 0 {
+		maxParamsLen = MaxParamsLen
+	}
+	pairs := encodePairs(env)
+	paramsLen := 0
+	for _, pair := range pairs {
+		paramsLen += len(pair)
 	}
-	if buf.Len() > MaxPairLen {
-		//fmt.Printf("pairs : %s\n", base64.StdEncoding.EncodeToString(buf.Bytes()))
-		return fmt.Errorf("build pair len exceed MaxPairLen of (%d)", MaxPairLen)
+	if paramsLen > maxParamsLen {
+		return &PairTooLongError{Field: "params", Len: paramsLen, Max: maxParamsLen}
 	}
 
-	err = writeBeginRequest(w, reqId)
+	err := writeBeginRequest(w, reqId, role, flags)
 	if err != nil {
 		return fmt.Errorf("cant write begin req %w", err)
 	}
-	err = writePairs(w, reqId, buf.Bytes())
+	err = writePairs(w, reqId, pairs)
 	if err != nil {
 		return fmt.Errorf("cant write pairs req %w", err)
 	}
-	err = writeStdin(w, reqId, []byte(body))
+	err = writeStream(w, FCGI_STDIN, reqId, body)
 	if err != nil {
 		return fmt.Errorf("cant write stdin req %w", err)
 	}
+	if role != FCGI_FILTER {
+		return nil
+	}
+	err = writeStream(w, FCGI_DATA, reqId, data)
+	if err != nil {
+		return fmt.Errorf("cant write data req %w", err)
+	}
 	return nil
 }
 
@@ -62,56 +97,60 @@ type RawResponse struct {
 	ProtocolStatus uint8
 }
 
-func readResponse(r io.Reader) (RawResponse, error) {
-	rr := RawResponse{}
-	rec := &Record{}
-	for {
-		err := rec.Read(r)
-		if err != nil {
-			if err == io.EOF {
-				break
+func writeBeginRequest(w recordWriter, reqId uint16, role uint8, flags uint8) error {
+	b := [8]byte{0, role, flags}
+	return w(FCGI_BEGIN_REQUEST, reqId, b[:])
+}
+
+// writePairs packs as many whole pairs as possible in each record, some
+// applications like php-fpm decode each record on its own. Only a pair
+// longer than a record is split across records.
+func writePairs(w recordWriter, reqId uint16, pairs [][]byte) error {
+	record := make([]byte, 0, MaxWrite)
+	for _, pair := range pairs {
+		if len(record) > 0 && len(record)+len(pair) > MaxWrite {
+			if err := w(FCGI_PARAMS, reqId, record); err != nil {
+				return fmt.Errorf("cannot write pair : %w", err)
 			}
-			return rr, fmt.Errorf("cannot read response : %w", err)
+			record = record[:0]
 		}
-		switch {
-		case rec.Header.Type == FCGI_STDOUT:
-			rr.Stdout = append(rr.Stdout, rec.Content()...)
-		case rec.Header.Type == FCGI_STDERR:
-			rr.Stderr = append(rr.Stderr, rec.Content()...)
-		case rec.Header.Type == FCGI_END_REQUEST:
-			endReq := rec.Content()
-			rr.AppStatus = binary.BigEndian.Uint32(endReq[0:4])
-			rr.ProtocolStatus = endReq[4]
-			break
-		default:
-			break
+		record = append(record, pair...)
+		for len(record) > MaxWrite {
+			if err := w(FCGI_PARAMS, reqId, record[:MaxWrite]); err != nil {
+				return fmt.Errorf("cannot write pair : %w", err)
+			}
+			record = append(record[:0], record[MaxWrite:]...)
 		}
 	}
-
-	return rr, nil
-}
-
-func writeBeginRequest(w recordWriter, reqId uint16) error {
-	role := uint16(FCGI_RESPONDER)
-	flags := uint8(0)
-	b := [8]byte{byte(role >> 8), byte(role), flags}
-	return w(FCGI_BEGIN_REQUEST, reqId, b[:])
-}
-
-func writePairs(w recordWriter, reqId uint16, pairs []byte) error {
-	err := w(FCGI_PARAMS, reqId, pairs)
-	if err != nil {
-		return fmt.Errorf("cannot write pair : %w", err)
+	if len(record) > 0 {
+		if err := w(FCGI_PARAMS, reqId, record); err != nil {
+			return fmt.Errorf("cannot write pair : %w", err)
+		}
 	}
 	return w(FCGI_PARAMS, reqId, nil)
 }
 
-func writeStdin(w recordWriter, reqId uint16, body []byte) error {
-	var err error
-	if len(body) > 0 {
-		err = w(FCGI_STDIN, reqId, body)
+// writeStream sends body as records of recType one at a time followed by
+// the empty record closing the stream.
+func writeStream(w recordWriter, recType uint8, reqId uint16, body io.Reader) error {
+	if body != nil {
+		b := make([]byte, MaxWrite)
+		for {
+			n, err := body.Read(b)
+			if n > 0 {
+				if err := w(recType, reqId, b[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("cannot read body : %w", err)
+			}
+		}
 	}
-	return err
+	return w(recType, reqId, nil)
 }
 
 func RawRecordWriter(w io.Writer) recordWriter {
@@ -150,3 +189,45 @@ func StreamRecordWriter(w io.Writer, maxWrite int) recordWriter {
 		return nil
 	}
 }
+
+// GetValues asks the application for the given variables with a
+// FCGI_GET_VALUES management record and returns the variables it knows.
+func GetValues(rw io.ReadWriter, names ...string) (map[string]string, error) {
+	query := make(Params, 0, len(names))
+	for _, name := range names {
+		query.Add(name, "")
+	}
+	buf := &bytes.Buffer{}
+	err := BuildPair(buf, query)
+	if err != nil {
+		return nil, fmt.Errorf("cant build pair : %w", err)
+	}
+	reqId := uint16(FCGI_NULL_REQUEST_ID)
+	err = RawRecordWriter(rw)(FCGI_GET_VALUES, reqId, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("cant write get values : %w", err)
+	}
+	rec := &Record{}
+	for {
+		err := rec.Read(rw)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("cannot read get values result : %w", err)
+		}
+		if rec.Header.Id != reqId {
+			continue
+		}
+		switch rec.Header.Type {
+		case FCGI_GET_VALUES_RESULT:
+			values, err := decodeEnv(bytes.NewReader(rec.Content()))
+			if err != nil {
+				return nil, err
+			}
+			return values.Map(), nil
+		case FCGI_UNKNOWN_TYPE:
+			return nil, fmt.Errorf("application does not support get values record")
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package fcgiprotocol
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetValues(t *testing.T) {
+	tests := map[string]struct {
+		Answer   uint8
+		Values   Params
+		Expected map[string]string
+		Error    string
+	}{
+		"known values": {
+			Answer:   FCGI_GET_VALUES_RESULT,
+			Values:   Params{{Key: FCGI_MAX_CONNS, Value: "5"}, {Key: FCGI_MPXS_CONNS, Value: "0"}},
+			Expected: map[string]string{FCGI_MAX_CONNS: "5", FCGI_MPXS_CONNS: "0"},
+		},
+		"unknown type": {
+			Answer: FCGI_UNKNOWN_TYPE,
+			Error:  "application does not support get values record",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				rec := Record{}
+				if err := rec.Read(server); err != nil {
+					return
+				}
+				content := []byte{rec.Header.Type, 0, 0, 0, 0, 0, 0, 0}
+				if tt.Answer == FCGI_GET_VALUES_RESULT {
+					content = MustBuildPairWithPadding(tt.Values, 0)
+				}
+				RawRecordWriter(server)(tt.Answer, rec.Header.Id, content)
+			}()
+			result, err := GetValues(client, FCGI_MAX_CONNS, FCGI_MAX_REQS, FCGI_MPXS_CONNS)
+			if tt.Error != "" {
+				if err == nil || err.Error() != tt.Error {
+					t.Fatalf("expected error want '%s' got '%v'", tt.Error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed getting values : %v", err)
+			}
+			if !reflect.DeepEqual(tt.Expected, result) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, result)
+			}
+		})
+	}
+}
+
+func TestWriteRequestParams(t *testing.T) {
+	tests := map[string]struct {
+		Env         Params
+		RecordLens  []int
+		MaxParamLen int
+	}{
+		"single record": {
+			Env:        Params{{Key: "B", Value: "2"}, {Key: "A", Value: "1"}},
+			RecordLens: []int{8, 0},
+		},
+		"pairs are not split across records": {
+			Env: Params{
+				{Key: "A", Value: strings.Repeat("a", 40000)},
+				{Key: "B", Value: strings.Repeat("b", 40000)},
+			},
+			RecordLens: []int{40006, 40006, 0},
+		},
+		"pair longer than a record": {
+			Env: Params{
+				{Key: "A", Value: strings.Repeat("a", 70000)},
+			},
+			RecordLens: []int{MaxWrite, 70006 - MaxWrite, 0},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := WriteRequest(RawRecordWriter(buf), 1, 0, tt.Env, nil)
+			if err != nil {
+				t.Fatalf("failed writing request : %v", err)
+			}
+			lens := []int{}
+			params := []byte{}
+			for {
+				rec := Record{}
+				if err := rec.Read(buf); err != nil {
+					break
+				}
+				if rec.Header.Type == FCGI_PARAMS {
+					lens = append(lens, len(rec.Content()))
+					params = append(params, rec.Content()...)
+				}
+			}
+			if !reflect.DeepEqual(tt.RecordLens, lens) {
+				t.Fatalf("record lens want %v got %v", tt.RecordLens, lens)
+			}
+			env, err := decodeEnv(bytes.NewReader(params))
+			if err != nil {
+				t.Fatalf("cannot decode params : %v", err)
+			}
+			if !reflect.DeepEqual(tt.Env, env) {
+				t.Fatalf("decoded params do not match")
+			}
+		})
+	}
+}
+
+func TestWriteRequestParamsTooLong(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := writeRoleRequest(RawRecordWriter(buf), 1, FCGI_RESPONDER, 0, Params{
+		{Key: "A", Value: strings.Repeat("a", 100)},
+	}, 100, nil, nil)
+	var tooLong *PairTooLongError
+	if !errors.As(err, &tooLong) {
+		t.Fatalf("want PairTooLongError got %v", err)
+	}
+	if want := (PairTooLongError{Field: "params", Len: 103, Max: 100}); *tooLong != want {
+		t.Fatalf("want %#v got %#v", want, *tooLong)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("want nothing written got %d bytes", buf.Len())
+	}
+}
+
+func TestWriteRoleRequest(t *testing.T) {
+	tests := map[string]struct {
+		Role     uint8
+		Expected Request
+	}{
+		"filter sends data after stdin": {
+			Role: FCGI_FILTER,
+			Expected: Request{
+				ReqId: 1,
+				Role:  uint16(FCGI_FILTER),
+				Env:   Params{{Key: "FCGI_DATA_LENGTH", Value: "7"}},
+				Stdin: []byte("body"),
+				Data:  []byte("# title"),
+			},
+		},
+		"responder ignores data": {
+			Role: FCGI_RESPONDER,
+			Expected: Request{
+				ReqId: 1,
+				Role:  uint16(FCGI_RESPONDER),
+				Env:   Params{{Key: "FCGI_DATA_LENGTH", Value: "7"}},
+				Stdin: []byte("body"),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := WriteRoleRequest(RawRecordWriter(buf), 1, tt.Role, 0, tt.Expected.Env, strings.NewReader("body"), strings.NewReader("# title"))
+			if err != nil {
+				t.Fatalf("failed writing request : %v", err)
+			}
+			records := []Record{}
+			for {
+				rec := Record{}
+				if err := rec.Read(buf); err != nil {
+					break
+				}
+				records = append(records, rec)
+			}
+			last := records[len(records)-1]
+			if tt.Role == FCGI_FILTER && (last.Header.Type != FCGI_DATA || len(last.Content()) != 0) {
+				t.Fatalf("want the data stream closed last got %#v", last.Header)
+			}
+			decoded, err := DecodeRequest(records)
+			if err != nil {
+				t.Fatalf("failed decoding request : %v", err)
+			}
+			if !reflect.DeepEqual(tt.Expected, decoded) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, decoded)
+			}
+		})
+	}
+}
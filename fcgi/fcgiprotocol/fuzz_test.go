@@ -0,0 +1,86 @@
+package fcgiprotocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// the fuzz targets only check that bad input gives an error, never a
+// panic, run one with go test -fuzz=FuzzDecodeRequest ./fcgi/fcgiprotocol
+
+func FuzzRecordRead(f *testing.F) {
+	buf := &bytes.Buffer{}
+	RawRecordWriter(buf)(FCGI_STDOUT, 1, []byte("Content-type: text/plain\r\n\r\nhello"))
+	f.Add(buf.Bytes())
+	f.Add([]byte{1, FCGI_PARAMS, 0, 1, 0xff, 0xff, 0xff, 0})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := bytes.NewReader(in)
+		for {
+			rec := Record{}
+			if err := rec.Read(r); err != nil {
+				return
+			}
+			if len(rec.Content()) != int(rec.Header.ContentLength) {
+				t.Fatalf("content len %d for header %#v", len(rec.Content()), rec.Header)
+			}
+		}
+	})
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	buf := &bytes.Buffer{}
+	WriteRequest(RawRecordWriter(buf), 1, 0, Params{{Key: "CONTENT_LENGTH", Value: "4"}, {Key: "SCRIPT_FILENAME", Value: "/index.php"}}, bytes.NewReader([]byte("body")))
+	f.Add(buf.Bytes())
+	f.Add([]byte{1, FCGI_BEGIN_REQUEST, 0, 1, 0, 8, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, FCGI_PARAMS, 0, 1, 0, 2, 6, 0, 0x80, 0xff})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := bytes.NewReader(in)
+		records := []Record{}
+		for {
+			rec := Record{}
+			if err := rec.Read(r); err != nil {
+				break
+			}
+			records = append(records, rec)
+		}
+		DecodeRequest(records)
+	})
+}
+
+func FuzzParseResponse(f *testing.F) {
+	f.Add("Status: 404 Not Found\r\nContent-type: text/html\r\n\r\nnot found")
+	f.Add("Location: /login\r\n\r\n")
+	f.Add("Content-type text/html\r\n")
+	f.Fuzz(func(t *testing.T, in string) {
+		ParseResponse(in)
+	})
+}
+
+func FuzzResponseReader(f *testing.F) {
+	buf := &bytes.Buffer{}
+	RawRecordWriter(buf)(FCGI_STDOUT, 1, []byte("Content-type: text/plain\r\n\r\n"))
+	RawRecordWriter(buf)(FCGI_STDERR, 1, []byte("warning"))
+	RawRecordWriter(buf)(FCGI_END_REQUEST, 1, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add(buf.Bytes())
+	f.Fuzz(func(t *testing.T, in []byte) {
+		io.ReadAll(NewResponseReader(bytes.NewReader(in), func([]byte) {}))
+	})
+}
+
+func FuzzPairReader(f *testing.F) {
+	f.Add([]byte{1, 1, 'a', '1', 0x80, 0, 0, 1, 1, 'b'})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		pr := NewPairReader(bytes.NewReader(in))
+		total := 0
+		for {
+			pair, err := pr.Next()
+			if err != nil {
+				break
+			}
+			total += len(pair.Key) + len(pair.Value)
+			if total > len(in) {
+				t.Fatalf("read %d bytes of pairs from %d bytes of input", total, len(in))
+			}
+		}
+	})
+}
@@ -5,10 +5,132 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"sort"
 )
 
-func MustBuildPairWithPadding(pairs map[string]string, padding int) []byte {
+// Pair is a name-value pair of FCGI_PARAMS or FCGI_GET_VALUES.
+type Pair struct {
+	Key   string
+	Value string
+}
+
+// PairReader reads the name-value pairs of FCGI_PARAMS or
+// FCGI_GET_VALUES content in wire order. The lengths announced on the
+// wire are checked against the limits before anything is allocated, a
+// zero limit means none.
+type PairReader struct {
+	MaxKeyLen   int
+	MaxValueLen int
+	// MaxTotalLen caps the encoded size of all the pairs read.
+	MaxTotalLen int
+
+	r     io.Reader
+	total int
+	err   error
+}
+
+// NewPairReader limits keys to MaxPairLen, values and the total to
+// MaxParamsLen.
+func NewPairReader(r io.Reader) *PairReader {
+	return &PairReader{
+		MaxKeyLen:   MaxPairLen,
+		MaxValueLen: MaxParamsLen,
+		MaxTotalLen: MaxParamsLen,
+		r:           r,
+	}
+}
+
+// Next returns the next pair, io.EOF once the input ends between two
+// pairs. After an error every call returns it again.
+func (pr *PairReader) Next() (Pair, error) {
+	if pr.err != nil {
+		return Pair{}, pr.err
+	}
+	pair, err := pr.next()
+	if err != nil {
+		pr.err = err
+	}
+	return pair, err
+}
+
+func (pr *PairReader) next() (Pair, error) {
+	keyLen, n, err := pr.readSize()
+	if err == io.EOF && n == 0 {
+		return Pair{}, io.EOF
+	}
+	if err != nil {
+		return Pair{}, err
+	}
+	valueLen, m, err := pr.readSize()
+	if err != nil {
+		return Pair{}, pr.truncated(err)
+	}
+	pr.total += n + m
+	if err := pr.check("key", keyLen, pr.MaxKeyLen); err != nil {
+		return Pair{}, err
+	}
+	if err := pr.check("value", valueLen, pr.MaxValueLen); err != nil {
+		return Pair{}, err
+	}
+	pr.total += keyLen + valueLen
+	if err := pr.check("params", pr.total, pr.MaxTotalLen); err != nil {
+		return Pair{}, err
+	}
+	key, err := pr.readString(keyLen)
+	if err != nil {
+		return Pair{}, err
+	}
+	value, err := pr.readString(valueLen)
+	if err != nil {
+		return Pair{}, err
+	}
+	return Pair{Key: key, Value: value}, nil
+}
+
+// readSize reads a length encoded on 1 byte, or on 4 bytes when the high
+// bit is set, n is the number of bytes it took.
+func (pr *PairReader) readSize() (int, int, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(pr.r, b[:1]); err != nil {
+		if err == io.EOF {
+			return 0, 0, io.EOF
+		}
+		return 0, 0, pr.truncated(err)
+	}
+	if b[0] <= 127 {
+		return int(b[0]), 1, nil
+	}
+	if _, err := io.ReadFull(pr.r, b[1:4]); err != nil {
+		return 0, 1, pr.truncated(err)
+	}
+	return int(binary.BigEndian.Uint32(b) &^ (1 << 31)), 4, nil
+}
+
+// readString grows with what is actually read so a length announced by
+// truncated input is never allocated at once.
+func (pr *PairReader) readString(n int) (string, error) {
+	buf := &bytes.Buffer{}
+	read, err := io.CopyN(buf, pr.r, int64(n))
+	if err != nil || int(read) != n {
+		return "", pr.truncated(err)
+	}
+	return buf.String(), nil
+}
+
+func (pr *PairReader) check(field string, n, max int) error {
+	if max > 0 && n > max {
+		return &PairTooLongError{Field: field, Len: n, Max: max}
+	}
+	return nil
+}
+
+func (pr *PairReader) truncated(err error) error {
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedPair
+	}
+	return err
+}
+
+func MustBuildPairWithPadding(pairs Params, padding int) []byte {
 	buf := &bytes.Buffer{}
 	err := BuildPair(buf, pairs)
 	if err != nil {
@@ -20,30 +142,30 @@ func MustBuildPairWithPadding(pairs map[string]string, padding int) []byte {
 	return buf.Bytes()
 }
 
-func BuildPair(w io.Writer, pairs map[string]string) error {
-	b := make([]byte, 8)
-	keys := make([]string, 0, len(pairs))
-	for k := range pairs {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		v := pairs[k]
-		n := encodeSize(b, uint32(len(k)))
-		n += encodeSize(b[n:], uint32(len(v)))
-		if _, err := w.Write(b[:n]); err != nil {
-			return err
-		}
-		if _, err := io.WriteString(w, k); err != nil {
-			return err
-		}
-		if _, err := io.WriteString(w, v); err != nil {
+// BuildPair writes the pairs in order.
+func BuildPair(w io.Writer, pairs Params) error {
+	for _, pair := range encodePairs(pairs) {
+		if _, err := w.Write(pair); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// encodePairs encodes each pair on its own, in order.
+func encodePairs(pairs Params) [][]byte {
+	encoded := make([][]byte, 0, len(pairs))
+	for _, pair := range pairs {
+		b := make([]byte, 8, 8+len(pair.Key)+len(pair.Value))
+		n := encodeSize(b, uint32(len(pair.Key)))
+		n += encodeSize(b[n:], uint32(len(pair.Value)))
+		b = append(b[:n], pair.Key...)
+		b = append(b, pair.Value...)
+		encoded = append(encoded, b)
+	}
+	return encoded
+}
+
 func encodeSize(b []byte, size uint32) int {
 	if size > 127 {
 		size |= 1 << 31
@@ -1,7 +1,10 @@
 package fcgiprotocol
 
 import (
+	"bytes"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -47,3 +50,97 @@ func TestEncodeSize(t *testing.T) {
 		})
 	}
 }
+
+func TestPairReader(t *testing.T) {
+	tests := map[string]struct {
+		In          []byte
+		MaxKeyLen   int
+		MaxValueLen int
+		MaxTotalLen int
+		Expected    []Pair
+		Error       error
+	}{
+		"pairs in wire order": {
+			In:       []byte{1, 1, 'b', '2', 1, 0, 'a'},
+			Expected: []Pair{{Key: "b", Value: "2"}, {Key: "a", Value: ""}},
+		},
+		"empty input": {
+			In: []byte{},
+		},
+		"long value": {
+			In:       append([]byte{1, 0x80, 0, 0, 200, 'k'}, bytes.Repeat([]byte{'v'}, 200)...),
+			Expected: []Pair{{Key: "k", Value: strings.Repeat("v", 200)}},
+		},
+		"truncated size": {
+			In:    []byte{1, 0x80, 0},
+			Error: ErrTruncatedPair,
+		},
+		"missing value size": {
+			In:    []byte{1},
+			Error: ErrTruncatedPair,
+		},
+		"truncated value": {
+			In:       []byte{1, 1, 'a', '1', 1, 3, 'b', '2'},
+			Expected: []Pair{{Key: "a", Value: "1"}},
+			Error:    ErrTruncatedPair,
+		},
+		"huge announced value": {
+			In:    []byte{1, 0xff, 0xff, 0xff, 0xff, 'a'},
+			Error: &PairTooLongError{Field: "value", Len: 1<<31 - 1, Max: MaxParamsLen},
+		},
+		"key over limit": {
+			In:        []byte{3, 0, 'a', 'b', 'c'},
+			MaxKeyLen: 2,
+			Error:     &PairTooLongError{Field: "key", Len: 3, Max: 2},
+		},
+		"value over limit": {
+			In:          []byte{1, 3, 'a', '1', '2', '3'},
+			MaxValueLen: 2,
+			Error:       &PairTooLongError{Field: "value", Len: 3, Max: 2},
+		},
+		"total over limit": {
+			In:          []byte{1, 1, 'a', '1', 1, 1, 'b', '2'},
+			MaxTotalLen: 6,
+			Expected:    []Pair{{Key: "a", Value: "1"}},
+			Error:       &PairTooLongError{Field: "params", Len: 8, Max: 6},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			pr := NewPairReader(bytes.NewReader(tt.In))
+			if tt.MaxKeyLen > 0 {
+				pr.MaxKeyLen = tt.MaxKeyLen
+			}
+			if tt.MaxValueLen > 0 {
+				pr.MaxValueLen = tt.MaxValueLen
+			}
+			if tt.MaxTotalLen > 0 {
+				pr.MaxTotalLen = tt.MaxTotalLen
+			}
+			var got []Pair
+			var err error
+			for {
+				var pair Pair
+				pair, err = pr.Next()
+				if err != nil {
+					break
+				}
+				got = append(got, pair)
+			}
+			if !reflect.DeepEqual(tt.Expected, got) {
+				t.Fatalf("pairs want \n%#v\ngot \n%#v\n", tt.Expected, got)
+			}
+			expectedErr := tt.Error
+			if expectedErr == nil {
+				expectedErr = io.EOF
+			}
+			if !reflect.DeepEqual(expectedErr, err) {
+				t.Fatalf("error want \n%#v\ngot \n%#v\n", expectedErr, err)
+			}
+			if _, again := pr.Next(); again != err {
+				t.Fatalf("error is not sticky, got %v then %v", err, again)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package fcgiprotocol
+
+import "sort"
+
+// Params are the name-value pairs of FCGI_PARAMS in wire order. Unlike a
+// map they keep the order a web server sent them in and the names sent
+// more than once, so a captured request can be written back with the same
+// params, though they may be split across other records. Names and values
+// are Go strings and may hold any bytes.
+//
+// When a name is repeated php keeps the last value, Get and Map do the
+// same.
+type Params []Pair
+
+// ParamsFromMap returns the pairs of m sorted by name.
+func ParamsFromMap(m map[string]string) Params {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make(Params, 0, len(names))
+	for _, name := range names {
+		params = append(params, Pair{Key: name, Value: m[name]})
+	}
+	return params
+}
+
+// Get returns the last value of name, "" when it is not set.
+func (p Params) Get(name string) string {
+	value, _ := p.Lookup(name)
+	return value
+}
+
+// Lookup returns the last value of name and whether it is set.
+func (p Params) Lookup(name string) (string, bool) {
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i].Key == name {
+			return p[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns every value of name in wire order.
+func (p Params) Values(name string) []string {
+	var values []string
+	for _, pair := range p {
+		if pair.Key == name {
+			values = append(values, pair.Value)
+		}
+	}
+	return values
+}
+
+// Add appends a pair, even when name is already set.
+func (p *Params) Add(name, value string) {
+	*p = append(*p, Pair{Key: name, Value: value})
+}
+
+// Set replaces the value of the first pair named name and removes the
+// others, the pair is appended when name is not set.
+func (p *Params) Set(name, value string) {
+	for i, pair := range *p {
+		if pair.Key == name {
+			(*p)[i].Value = value
+			*p = append((*p)[:i+1], (*p)[i+1:].without(name)...)
+			return
+		}
+	}
+	p.Add(name, value)
+}
+
+// Del removes every pair named name.
+func (p *Params) Del(name string) {
+	*p = p.without(name)
+}
+
+// Override removes the names set by q then appends q as it is, in its
+// order and with its repeated names.
+func (p *Params) Override(q Params) {
+	for _, pair := range q {
+		p.Del(pair.Key)
+	}
+	*p = append(*p, q...)
+}
+
+func (p Params) without(name string) Params {
+	kept := p[:0]
+	for _, pair := range p {
+		if pair.Key != name {
+			kept = append(kept, pair)
+		}
+	}
+	return kept
+}
+
+// Map returns the params as php sees them, the last value of a repeated
+// name wins.
+func (p Params) Map() map[string]string {
+	m := make(map[string]string, len(p))
+	for _, pair := range p {
+		m[pair.Key] = pair.Value
+	}
+	return m
+}
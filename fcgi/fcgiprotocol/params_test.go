@@ -0,0 +1,110 @@
+package fcgiprotocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	tests := map[string]struct {
+		Edit     func(p *Params)
+		Expected Params
+	}{
+		"add keeps duplicates": {
+			Edit:     func(p *Params) { p.Add("B", "3") },
+			Expected: Params{{Key: "B", Value: "1"}, {Key: "A", Value: "2"}, {Key: "B", Value: "3"}},
+		},
+		"set replaces the first and removes the others": {
+			Edit: func(p *Params) {
+				p.Add("B", "3")
+				p.Set("B", "4")
+			},
+			Expected: Params{{Key: "B", Value: "4"}, {Key: "A", Value: "2"}},
+		},
+		"set appends a new name": {
+			Edit:     func(p *Params) { p.Set("C", "5") },
+			Expected: Params{{Key: "B", Value: "1"}, {Key: "A", Value: "2"}, {Key: "C", Value: "5"}},
+		},
+		"del removes every pair": {
+			Edit: func(p *Params) {
+				p.Add("B", "3")
+				p.Del("B")
+			},
+			Expected: Params{{Key: "A", Value: "2"}},
+		},
+		"override appends in order": {
+			Edit: func(p *Params) {
+				p.Override(Params{{Key: "C", Value: "3"}, {Key: "B", Value: "4"}, {Key: "B", Value: "5"}})
+			},
+			Expected: Params{{Key: "A", Value: "2"}, {Key: "C", Value: "3"}, {Key: "B", Value: "4"}, {Key: "B", Value: "5"}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := Params{{Key: "B", Value: "1"}, {Key: "A", Value: "2"}}
+			tt.Edit(&p)
+			if !reflect.DeepEqual(tt.Expected, p) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, p)
+			}
+		})
+	}
+}
+
+func TestParamsLookup(t *testing.T) {
+	p := Params{{Key: "X", Value: "1"}, {Key: "Y", Value: ""}, {Key: "X", Value: "2"}}
+	if got := p.Get("X"); got != "2" {
+		t.Fatalf("want last value 2 got %s", got)
+	}
+	if value, ok := p.Lookup("Y"); !ok || value != "" {
+		t.Fatalf("want Y set and empty got %q %v", value, ok)
+	}
+	if _, ok := p.Lookup("Z"); ok {
+		t.Fatalf("want Z unset")
+	}
+	if got := p.Values("X"); !reflect.DeepEqual([]string{"1", "2"}, got) {
+		t.Fatalf("want values [1 2] got %v", got)
+	}
+	if got := p.Map(); !reflect.DeepEqual(map[string]string{"X": "2", "Y": ""}, got) {
+		t.Fatalf("want map of last values got %v", got)
+	}
+	if got := ParamsFromMap(map[string]string{"B": "1", "A": "2"}); !reflect.DeepEqual(Params{{Key: "A", Value: "2"}, {Key: "B", Value: "1"}}, got) {
+		t.Fatalf("want pairs sorted by name got %v", got)
+	}
+}
+
+func TestRequestReplay(t *testing.T) {
+	captured := &bytes.Buffer{}
+	err := WriteRequest(RawRecordWriter(captured), 1, 0, Params{
+		{Key: "SCRIPT_FILENAME", Value: "/var/www/index.php"},
+		{Key: "HTTP_COOKIE", Value: "a=1"},
+		{Key: "CONTENT_LENGTH", Value: "4"},
+		{Key: "HTTP_COOKIE", Value: "b=\x00\xff"},
+	}, bytes.NewReader([]byte("body")))
+	if err != nil {
+		t.Fatalf("failed writing request : %v", err)
+	}
+	r := bytes.NewReader(captured.Bytes())
+	records := []Record{}
+	for {
+		rec := Record{}
+		if err := rec.Read(r); err != nil {
+			break
+		}
+		records = append(records, rec)
+	}
+	decoded, err := DecodeRequest(records)
+	if err != nil {
+		t.Fatalf("failed decoding request : %v", err)
+	}
+
+	replayed := &bytes.Buffer{}
+	err = WriteRequest(RawRecordWriter(replayed), decoded.ReqId, 0, decoded.Env, bytes.NewReader(decoded.Stdin))
+	if err != nil {
+		t.Fatalf("failed replaying request : %v", err)
+	}
+	if !bytes.Equal(captured.Bytes(), replayed.Bytes()) {
+		t.Fatalf("want \n%#v\ngot \n%#v\n", captured.Bytes(), replayed.Bytes())
+	}
+}
@@ -0,0 +1,136 @@
+package fcgiprotocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errResponseClosed = errors.New("fcgi: response closed")
+
+// ResponseReader reads the records of a response as they arrive. Read
+// returns the content of FCGI_STDOUT records, the content of FCGI_STDERR
+// records is given to the stderr callback. Read returns io.EOF once
+// FCGI_END_REQUEST is received, AppStatus and ProtocolStatus are set from
+// then on. A protocol status other than FCGI_REQUEST_COMPLETE is returned
+// instead of io.EOF as ErrCantMultiplex, ErrOverloaded or ErrUnknownRole.
+type ResponseReader struct {
+	AppStatus      uint32
+	ProtocolStatus uint8
+
+	ctx    context.Context
+	next   func(rec *Record) error
+	stderr func([]byte)
+	done   func(err error)
+	rec    Record
+	stdout []byte
+	err    error
+}
+
+func NewResponseReader(r io.Reader, stderr func([]byte)) *ResponseReader {
+	return newResponseReader(
+		context.Background(),
+		func(rec *Record) error { return rec.Read(r) },
+		stderr,
+		nil,
+	)
+}
+
+// newResponseReader calls done once, with io.EOF when the response is
+// over, with the error which stopped it otherwise.
+func newResponseReader(ctx context.Context, next func(rec *Record) error, stderr func([]byte), done func(err error)) *ResponseReader {
+	return &ResponseReader{
+		ctx:    ctx,
+		next:   next,
+		stderr: stderr,
+		done:   done,
+	}
+}
+
+func (rr *ResponseReader) Read(p []byte) (int, error) {
+	if err := rr.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, rr.stdout)
+	rr.stdout = rr.stdout[n:]
+	return n, nil
+}
+
+// Close abandons the response if it is not over yet.
+func (rr *ResponseReader) Close() error {
+	if rr.err == nil {
+		rr.err = errResponseClosed
+		rr.finish(rr.err)
+	}
+	return nil
+}
+
+// fill reads records until some stdout is available or the response is
+// over.
+func (rr *ResponseReader) fill() error {
+	for len(rr.stdout) == 0 {
+		if rr.err != nil {
+			return rr.err
+		}
+		rr.err = rr.readRecord()
+	}
+	return nil
+}
+
+func (rr *ResponseReader) readRecord() error {
+	err := rr.next(&rr.rec)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return rr.finish(fmt.Errorf("cannot read response : %w : %w", ErrMissingEndRequest, io.ErrUnexpectedEOF))
+		}
+		return rr.finish(fmt.Errorf("cannot read response : %w", err))
+	}
+	switch rr.rec.Header.Type {
+	case FCGI_STDOUT:
+		rr.stdout = rr.rec.Content()
+	case FCGI_STDERR:
+		if rr.stderr != nil && len(rr.rec.Content()) > 0 {
+			rr.stderr(rr.rec.Content())
+		}
+	case FCGI_END_REQUEST:
+		endReq := rr.rec.Content()
+		if len(endReq) < 8 {
+			return rr.finish(fmt.Errorf("cannot read response : %w", ErrTruncatedEndRequest))
+		}
+		rr.AppStatus = binary.BigEndian.Uint32(endReq[0:4])
+		rr.ProtocolStatus = endReq[4]
+		if err := protocolStatusError(rr.ProtocolStatus); err != nil {
+			return rr.finish(err)
+		}
+		return rr.finish(io.EOF)
+	}
+	return nil
+}
+
+func (rr *ResponseReader) finish(err error) error {
+	if err != errResponseClosed && rr.ctx.Err() != nil {
+		err = fmt.Errorf("request aborted : %w", rr.ctx.Err())
+	}
+	if rr.done != nil {
+		rr.done(err)
+		rr.done = nil
+	}
+	return err
+}
+
+// readAll runs a request opened by open and buffers its whole response.
+func readAll(open func(stderr func([]byte)) (*ResponseReader, error)) (RawResponse, error) {
+	raw := RawResponse{}
+	rr, err := open(func(b []byte) {
+		raw.Stderr = append(raw.Stderr, b...)
+	})
+	if err != nil {
+		return raw, err
+	}
+	raw.Stdout, err = io.ReadAll(rr)
+	raw.AppStatus = rr.AppStatus
+	raw.ProtocolStatus = rr.ProtocolStatus
+	return raw, err
+}
@@ -0,0 +1,120 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
+	"app/pkg/http/middleware"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Authorizer asks an FCGI_AUTHORIZER application whether the requests of
+// the paths it guards are allowed, its Authorize method is meant for
+// Handler.Authorize and Guard puts it in front of any handler. A single
+// Authorizer can guard several Handlers.
+type Authorizer struct {
+	Backend
+
+	Server       fcgiclient.ServerInfo
+	DocumentRoot string
+	// Index is the script of the authorizer.
+	Index string
+	// Env is added to the params of every authorizer request.
+	Env fcgiprotocol.Params
+	// Paths are the url path prefixes guarded, every request when empty.
+	Paths []string
+	// ErrorHandler answers the requests of Guard the authorizer could not
+	// be asked about, the default sends ErrorStatus.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Authorize sends r to the authorizer without its body, the requests of
+// paths it does not guard are allowed.
+func (a *Authorizer) Authorize(r *http.Request) (fcgiclient.Authorization, error) {
+	if !a.guards(r.URL.Path) {
+		return fcgiclient.Authorization{Allowed: true}, nil
+	}
+	transport := &fcgiclient.Transport{
+		Server:       a.Server,
+		DocumentRoot: a.DocumentRoot,
+		Index:        a.Index,
+		Env:          a.Env,
+	}
+	req, err := transport.NewRequest(withoutBody(r))
+	if err != nil {
+		return fcgiclient.Authorization{}, err
+	}
+	return a.getClient().Authorize(r.Context(), req)
+}
+
+type authorizationKey struct{}
+
+// Guard serves the requests Authorize allows with next and answers the
+// others with the response of the authorizer, static files included. A
+// Handler serving an allowed request adds its Variables to the params
+// without asking again.
+func (a *Authorizer) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, err := a.Authorize(r)
+		if err != nil {
+			closeBody(r)
+			a.error(w, r, fmt.Errorf("cannot authorize request : %w", err))
+			return
+		}
+		if !auth.Allowed {
+			closeBody(r)
+			if err := deny(w, r, auth.Response); err != nil {
+				log.Printf("fcgiproxy: authorizer %s : %v", r.URL, err)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authorizationKey{}, auth)))
+	})
+}
+
+// authorized returns the authorization Guard gave r, if any.
+func authorized(r *http.Request) (fcgiclient.Authorization, bool) {
+	auth, ok := r.Context().Value(authorizationKey{}).(fcgiclient.Authorization)
+	return auth, ok
+}
+
+// deny sends the response of the authorizer which denied r, a 403
+// without one.
+func deny(w http.ResponseWriter, r *http.Request, sr *fcgiclient.StreamResponse) error {
+	if sr == nil {
+		middleware.Respond(w, "forbidden", http.StatusForbidden, nil)
+		return nil
+	}
+	rsp := sr.HTTPResponse(r)
+	defer rsp.Body.Close()
+	err := middleware.RespondStream(w, rsp.Body, rsp.StatusCode, rsp.Header)
+	if err != nil {
+		return fmt.Errorf("cannot stream authorizer response : %w", err)
+	}
+	return nil
+}
+
+func (a *Authorizer) error(w http.ResponseWriter, r *http.Request, err error) {
+	if a.ErrorHandler != nil {
+		a.ErrorHandler(w, r, err)
+		return
+	}
+	log.Printf("fcgiproxy: authorizer %s : %v", r.URL, err)
+	statusCode := ErrorStatus(err)
+	middleware.Respond(w, strings.ToLower(http.StatusText(statusCode)), statusCode, nil)
+}
+
+func (a *Authorizer) guards(urlPath string) bool {
+	if len(a.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range a.Paths {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerAuthorize(t *testing.T) {
+	auth := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		if r.Role != uint16(fcgiprotocol.FCGI_AUTHORIZER) || r.Env["SCRIPT_FILENAME"] != "/srv/auth/auth.php" {
+			fmt.Fprint(w, "Status: 500\r\n\r\nwrong request")
+			return
+		}
+		if r.Env["HTTP_X_TOKEN"] != "secret" {
+			fmt.Fprint(w, "Status: 403 Forbidden\r\nContent-type: text/plain\r\n\r\ndenied")
+			return
+		}
+		fmt.Fprint(w, "Variable-Remote-User: bob\r\n\r\n")
+	})
+	defer auth.Close()
+	app := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		fmt.Fprintf(w, "Content-type: text/plain\r\n\r\n%s %s %s", r.Env["REQUEST_METHOD"], r.Env["REQUEST_URI"], r.Env["REMOTE_USER"])
+	})
+	defer app.Close()
+
+	authorizer := &Authorizer{
+		Backend:      Backend{Dial: auth.Dial},
+		DocumentRoot: "/srv/auth",
+		Index:        "auth.php",
+		Paths:        []string{"/admin/"},
+	}
+	ts := httptest.NewServer(&Handler{
+		Backend:      Backend{Dial: app.Dial},
+		DocumentRoot: "/var/www",
+		Index:        "index.php",
+		Authorize:    authorizer.Authorize,
+		ErrorLog:     func(r *http.Request, err error) {},
+	})
+	defer ts.Close()
+
+	tests := map[string]struct {
+		Path       string
+		Token      string
+		StatusCode int
+		Body       string
+	}{
+		"allowed": {
+			Path:       "/admin/users",
+			Token:      "secret",
+			StatusCode: http.StatusOK,
+			Body:       "POST /admin/users bob",
+		},
+		"denied": {
+			Path:       "/admin/users",
+			Token:      "guess",
+			StatusCode: http.StatusForbidden,
+			Body:       "denied",
+		},
+		"not guarded": {
+			Path:       "/blog",
+			StatusCode: http.StatusOK,
+			Body:       "POST /blog ",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+tt.Path, nil)
+			if err != nil {
+				t.Fatalf("cannot build request : %v", err)
+			}
+			req.Header.Set("X-Token", tt.Token)
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed running request : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, rsp.StatusCode)
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiclient"
+	"sync"
+)
+
+// Backend is the FastCGI application a Handler, a Filter or an Authorizer
+// sends its requests to.
+type Backend struct {
+	// Client sends the requests, when nil one is built from Dial.
+	Client *fcgiclient.Client
+	Dial   fcgiclient.DialFunc
+
+	once   sync.Once
+	client *fcgiclient.Client
+}
+
+func (b *Backend) getClient() *fcgiclient.Client {
+	if b.Client != nil {
+		return b.Client
+	}
+	b.once.Do(func() {
+		b.client = &fcgiclient.Client{
+			Dial:         b.Dial,
+			MaxIdleConns: fcgiclient.DefaultMaxIdleConns,
+			IdleTimeout:  fcgiclient.DefaultIdleTimeout,
+		}
+	})
+	return b.client
+}
@@ -0,0 +1,117 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
+	"app/pkg/http/middleware"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Filter serves the files of DocumentRoot through an FCGI_FILTER
+// application, which gets the file as its FCGI_DATA stream and answers
+// with what is sent to the client, a Markdown file rendered as html for
+// instance.
+type Filter struct {
+	Backend
+
+	Server fcgiclient.ServerInfo
+	// DocumentRoot holds the filtered files.
+	DocumentRoot string
+	// ScriptRoot and Index are where the filter application finds its
+	// script.
+	ScriptRoot string
+	Index      string
+	// Env is added to the params of every filter request.
+	Env fcgiprotocol.Params
+	// Extensions are the extensions of the filtered files, like .md, all
+	// files when empty. php scripts and hidden files are never filtered.
+	Extensions []string
+
+	// ErrorHandler answers the request when the filter could not be
+	// reached or sent an invalid response, the default sends ErrorStatus.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Match reports whether the url path names a file the filter serves.
+func (f *Filter) Match(urlPath string) bool {
+	name := path.Clean("/" + urlPath)
+	if !f.filters(name) {
+		return false
+	}
+	info, err := os.Stat(path.Join(f.DocumentRoot, name))
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (f *Filter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	closeBody(r)
+	name := path.Clean("/" + r.URL.Path)
+	if !f.filters(name) {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(path.Join(f.DocumentRoot, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	transport := &fcgiclient.Transport{
+		Server:       f.Server,
+		DocumentRoot: f.ScriptRoot,
+		Index:        f.Index,
+		Env:          f.Env,
+	}
+	req, err := transport.NewRequest(withoutBody(r))
+	if err != nil {
+		f.error(w, r, err)
+		return
+	}
+	req, err = fcgiclient.FilterFile(req, file)
+	if err != nil {
+		f.error(w, r, err)
+		return
+	}
+	sr, err := f.getClient().Stream(r.Context(), req)
+	if err != nil {
+		f.error(w, r, fmt.Errorf("cannot make request to filter : %w", err))
+		return
+	}
+	defer sr.Body.Close()
+
+	rsp := sr.HTTPResponse(r)
+	err = middleware.RespondStream(w, rsp.Body, rsp.StatusCode, rsp.Header)
+	if err != nil {
+		log.Printf("fcgiproxy: filter %s : cannot stream response : %v", r.URL, err)
+	}
+}
+
+func (f *Filter) filters(name string) bool {
+	if isScript(name) || strings.HasPrefix(path.Base(name), ".") {
+		return false
+	}
+	if len(f.Extensions) == 0 {
+		return true
+	}
+	for _, ext := range f.Extensions {
+		if strings.EqualFold(path.Ext(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) error(w http.ResponseWriter, r *http.Request, err error) {
+	if f.ErrorHandler != nil {
+		f.ErrorHandler(w, r, err)
+		return
+	}
+	log.Printf("fcgiproxy: filter %s : %v", r.URL, err)
+	statusCode := ErrorStatus(err)
+	middleware.Respond(w, strings.ToLower(http.StatusText(statusCode)), statusCode, nil)
+}
@@ -0,0 +1,98 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgitest"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		fmt.Fprintf(w, "Content-type: text/html\r\n\r\n<h1>%s</h1> %s %s", strings.TrimPrefix(string(r.Data), "# "), r.Env["SCRIPT_FILENAME"], r.Env["SCRIPT_NAME"])
+	})
+	defer srv.Close()
+
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"readme.md":  "# title",
+		"index.php":  "<?php echo 'secret';",
+		".notes.md":  "# hidden",
+		"styles.css": "body{}",
+	} {
+		if err := os.WriteFile(path.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("cannot write file : %v", err)
+		}
+	}
+	f := &Filter{
+		Backend:      Backend{Dial: srv.Dial},
+		DocumentRoot: root,
+		ScriptRoot:   "/srv/filter",
+		Index:        "markdown.php",
+		Extensions:   []string{".md"},
+	}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	tests := map[string]struct {
+		Path       string
+		Match      bool
+		StatusCode int
+		Body       string
+	}{
+		"filtered": {
+			Path:       "/readme.md",
+			Match:      true,
+			StatusCode: http.StatusOK,
+			Body:       "<h1>title</h1> /srv/filter/markdown.php /markdown.php",
+		},
+		"other extension": {
+			Path:       "/styles.css",
+			StatusCode: http.StatusNotFound,
+			Body:       "404 page not found\n",
+		},
+		"php script": {
+			Path:       "/index.php",
+			StatusCode: http.StatusNotFound,
+			Body:       "404 page not found\n",
+		},
+		"hidden file": {
+			Path:       "/.notes.md",
+			StatusCode: http.StatusNotFound,
+			Body:       "404 page not found\n",
+		},
+		"missing file": {
+			Path:       "/missing.md",
+			StatusCode: http.StatusNotFound,
+			Body:       "404 page not found\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if f.Match(tt.Path) != tt.Match {
+				t.Fatalf("want match %v", tt.Match)
+			}
+			rsp, err := http.Get(ts.URL + tt.Path)
+			if err != nil {
+				t.Fatalf("failed running request : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, rsp.StatusCode)
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+		})
+	}
+}
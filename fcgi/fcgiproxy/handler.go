@@ -0,0 +1,235 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
+	"app/pkg/http/middleware"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Handler is an http.Handler sending the requests it serves to a FastCGI
+// application, the way httputil.ReverseProxy does for http backends.
+//
+// The response is streamed to the client unless the script sends
+// X-Accel-Buffering: yes. Local redirects asked by the script are served
+// by LocalRedirect as a GET without body.
+type Handler struct {
+	Backend
+
+	// Server describes the web server in the params of the requests.
+	Server fcgiclient.ServerInfo
+
+	DocumentRoot string
+	// RemoteRoot is DocumentRoot as php-fpm sees it, see
+	// fcgiclient.Request.RemoteRoot.
+	RemoteRoot string
+	// Index is the script run when SplitPath is nil or does not match.
+	Index string
+	// SplitPath is given to every request, see fcgiclient.Request.SplitPath.
+	SplitPath fcgiclient.SplitPathFunc
+	// Env is added to the params of every request.
+	Env fcgiprotocol.Params
+	// Authorize, when set, is asked about every request before it is
+	// sent, see Authorizer. A denied request gets the response of the
+	// authorizer, the Variables of an allowed one are added to its params.
+	// Requests already allowed by Authorizer.Guard are not asked again.
+	Authorize func(r *http.Request) (fcgiclient.Authorization, error)
+
+	// Director can change the params of a request right before they are
+	// sent, they are sent in the order it leaves them.
+	Director func(r *http.Request, params *fcgiprotocol.Params)
+	// ModifyResponse can change the response of the application before it
+	// is written, an error is given to ErrorHandler.
+	ModifyResponse func(rsp *http.Response) error
+	// ErrorHandler answers the request when the application could not
+	// be reached or sent an invalid response, the default sends
+	// ErrorStatus.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// ErrorLog gets the errors happening once the response started, the
+	// default logs them with the log package.
+	ErrorLog func(r *http.Request, err error)
+	// Stderr gets what the application writes on stderr as it comes.
+	Stderr func(r *http.Request, b []byte)
+	// LocalRedirect serves local redirects, the Handler itself when nil.
+	LocalRedirect http.Handler
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authorized(r)
+	if !ok && h.Authorize != nil {
+		var err error
+		auth, err = h.Authorize(r)
+		if err != nil {
+			closeBody(r)
+			h.error(w, r, fmt.Errorf("cannot authorize request : %w", err))
+			return
+		}
+		if !auth.Allowed {
+			closeBody(r)
+			if err := deny(w, r, auth.Response); err != nil {
+				h.logError(r, err)
+			}
+			return
+		}
+	}
+
+	transport := &fcgiclient.Transport{
+		Server:       h.Server,
+		DocumentRoot: h.DocumentRoot,
+		RemoteRoot:   h.RemoteRoot,
+		Index:        h.Index,
+		SplitPath:    h.SplitPath,
+		Env:          h.Env,
+		Director:     h.Director,
+	}
+	req, err := transport.NewRequest(r)
+	if err != nil {
+		closeBody(r)
+		h.error(w, r, err)
+		return
+	}
+	req.Env.Override(fcgiprotocol.ParamsFromMap(auth.Variables))
+	if h.Stderr != nil {
+		req.Stderr = func(b []byte) {
+			h.Stderr(r, b)
+		}
+	}
+
+	sr, err := h.getClient().Stream(r.Context(), req)
+	closeBody(r)
+	if err != nil {
+		h.error(w, r, fmt.Errorf("cannot make request to php : %w", err))
+		return
+	}
+	defer sr.Body.Close()
+
+	if sr.LocalRedirect != "" {
+		sr.Body.Close()
+		h.localRedirect(w, r, sr.LocalRedirect)
+		return
+	}
+
+	rsp := sr.HTTPResponse(r)
+	if h.ModifyResponse != nil {
+		if err := h.ModifyResponse(rsp); err != nil {
+			h.error(w, r, fmt.Errorf("cannot modify php response : %w", err))
+			return
+		}
+		defer rsp.Body.Close()
+	}
+
+	if buffered := takeAccelBuffering(rsp.Header); buffered {
+		body, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			h.error(w, r, fmt.Errorf("cannot read php response : %w", err))
+			return
+		}
+		middleware.Respond(w, string(body), rsp.StatusCode, rsp.Header)
+		return
+	}
+
+	err = middleware.RespondStream(w, rsp.Body, rsp.StatusCode, rsp.Header)
+	if err != nil {
+		h.logError(r, fmt.Errorf("cannot stream php response : %w", err))
+	}
+}
+
+type localRedirectsKey struct{}
+
+// localRedirect serves location instead of r as a GET request without
+// body, as RFC 3875 section 6.2.2 asks for.
+func (h *Handler) localRedirect(w http.ResponseWriter, r *http.Request, location string) {
+	redirects, _ := r.Context().Value(localRedirectsKey{}).(int)
+	if redirects >= fcgiclient.MaxLocalRedirects {
+		h.error(w, r, fmt.Errorf("cannot follow local redirect to %s : more than %d redirects", location, fcgiclient.MaxLocalRedirects))
+		return
+	}
+	target, err := url.Parse(location)
+	if err != nil {
+		h.error(w, r, fmt.Errorf("cannot parse local redirect %s : %w", location, err))
+		return
+	}
+
+	redirected := r.Clone(context.WithValue(r.Context(), localRedirectsKey{}, redirects+1))
+	redirected.Method = http.MethodGet
+	redirected.URL = r.URL.ResolveReference(target)
+	redirected.RequestURI = target.RequestURI()
+	redirected.Body = http.NoBody
+	redirected.ContentLength = 0
+	redirected.Header.Del("Content-Length")
+	redirected.Header.Del("Content-Type")
+
+	next := h.LocalRedirect
+	if next == nil {
+		next = h
+	}
+	next.ServeHTTP(w, redirected)
+}
+
+func (h *Handler) error(w http.ResponseWriter, r *http.Request, err error) {
+	if h.ErrorHandler != nil {
+		h.ErrorHandler(w, r, err)
+		return
+	}
+	statusCode := ErrorStatus(err)
+	if statusCode != http.StatusRequestHeaderFieldsTooLarge {
+		// too many headers is the client's fault
+		h.logError(r, err)
+	}
+	middleware.Respond(w, strings.ToLower(http.StatusText(statusCode)), statusCode, nil)
+}
+
+// ErrorStatus is the status answering err: 431 when the params are over
+// their limit, 503 when php-fpm is overloaded, 500 when the script failed,
+// 502 when php-fpm broke the protocol or could not be reached.
+func ErrorStatus(err error) int {
+	var tooLong *fcgiprotocol.PairTooLongError
+	var appErr *fcgiprotocol.AppError
+	switch {
+	case errors.As(err, &tooLong):
+		return http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, fcgiprotocol.ErrOverloaded):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &appErr):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
+
+func (h *Handler) logError(r *http.Request, err error) {
+	if h.ErrorLog != nil {
+		h.ErrorLog(r, err)
+		return
+	}
+	log.Printf("fcgiproxy: %s %s : %v", r.Method, r.URL, err)
+}
+
+// takeAccelBuffering removes the X-Accel-Buffering header, like nginx
+// does, and reports whether php asked for the response to be buffered.
+func takeAccelBuffering(headers http.Header) bool {
+	value := headers.Get("X-Accel-Buffering")
+	headers.Del("X-Accel-Buffering")
+	return strings.EqualFold(value, "yes")
+}
+
+// withoutBody is r for the requests sent to an authorizer or a filter,
+// they do not get the body.
+func withoutBody(r *http.Request) *http.Request {
+	r = r.WithContext(r.Context())
+	r.Body = nil
+	r.ContentLength = 0
+	return r
+}
+
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
@@ -0,0 +1,184 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiclient"
+	"app/fcgi/fcgiprotocol"
+	"app/fcgi/fcgitest"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	srv := fcgitest.NewServer(func(w *fcgitest.ResponseWriter, r *fcgitest.Request) {
+		switch r.Env["DOCUMENT_URI"] {
+		case "/redirect":
+			fmt.Fprint(w, "Location: /target\r\n\r\n")
+			return
+		case "/warn":
+			fmt.Fprint(w.Stderr, "deprecated")
+		case "/malformed":
+			fmt.Fprint(w, "Content-Type text/plain\r\n\r\n")
+			return
+		}
+		fmt.Fprint(w, "Content-type: text/plain\r\nX-Powered-By: php\r\n\r\n")
+		fmt.Fprintf(w, "%s %s %s %s", r.Env["REQUEST_METHOD"], r.Env["DOCUMENT_URI"], r.Env["REQUEST_URI"], r.Env["APP_ENV"])
+	})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	stderr := ""
+	h := &Handler{
+		Backend:      Backend{Dial: srv.Dial},
+		DocumentRoot: "/var/www",
+		Index:        "index.php",
+		Director: func(r *http.Request, params *fcgiprotocol.Params) {
+			params.Set("APP_ENV", r.Header.Get("X-Env"))
+		},
+		ModifyResponse: func(rsp *http.Response) error {
+			rsp.Header.Del("X-Powered-By")
+			rsp.Header.Set("X-Proxy", "fcgiproxy")
+			return nil
+		},
+		Stderr: func(r *http.Request, b []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			stderr += string(b)
+		},
+		ErrorLog: func(r *http.Request, err error) {},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.Handle("/app/", http.StripPrefix("/app", h))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := map[string]struct {
+		Method     string
+		Path       string
+		StatusCode int
+		Header     http.Header
+		Body       string
+		Stderr     string
+	}{
+		"director and modify response": {
+			Method:     "POST",
+			Path:       "/users?page=2",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}, "X-Proxy": {"fcgiproxy"}},
+			Body:       "POST /users /users?page=2 test",
+		},
+		"mounted under a prefix": {
+			Method:     "GET",
+			Path:       "/app/users",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}, "X-Proxy": {"fcgiproxy"}},
+			Body:       "GET /users /users test",
+		},
+		"local redirect": {
+			Method:     "POST",
+			Path:       "/redirect",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}, "X-Proxy": {"fcgiproxy"}},
+			Body:       "GET /target /target test",
+		},
+		"stderr": {
+			Method:     "GET",
+			Path:       "/warn",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}, "X-Proxy": {"fcgiproxy"}},
+			Body:       "GET /warn /warn test",
+			Stderr:     "deprecated",
+		},
+		"malformed response": {
+			Method:     "GET",
+			Path:       "/malformed",
+			StatusCode: http.StatusBadGateway,
+			Body:       "bad gateway",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			mu.Lock()
+			stderr = ""
+			mu.Unlock()
+			req, err := http.NewRequest(tt.Method, ts.URL+tt.Path, strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("cannot build request : %v", err)
+			}
+			req.Header.Set("X-Env", "test")
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed running request : %v", err)
+			}
+			defer rsp.Body.Close()
+			body, err := io.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("cannot read body : %v", err)
+			}
+			if rsp.StatusCode != tt.StatusCode {
+				t.Fatalf("want status %d got %d", tt.StatusCode, rsp.StatusCode)
+			}
+			for key, values := range tt.Header {
+				if got := rsp.Header.Values(key); strings.Join(got, ",") != strings.Join(values, ",") {
+					t.Fatalf("want header %s %v got %v", key, values, got)
+				}
+			}
+			if rsp.Header.Get("X-Powered-By") != "" {
+				t.Fatalf("X-Powered-By should be removed by ModifyResponse")
+			}
+			if string(body) != tt.Body {
+				t.Fatalf("want \n%s\ngot \n%s\n", tt.Body, body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if stderr != tt.Stderr {
+				t.Fatalf("want stderr %q got %q", tt.Stderr, stderr)
+			}
+		})
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	unreachable := func() (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	tests := map[string]struct {
+		Handler    *Handler
+		StatusCode int
+		Body       string
+	}{
+		"default error handler": {
+			Handler:    &Handler{Backend: Backend{Dial: unreachable}, ErrorLog: func(r *http.Request, err error) {}},
+			StatusCode: http.StatusBadGateway,
+			Body:       "bad gateway",
+		},
+		"custom error handler": {
+			Handler: &Handler{
+				Backend: Backend{Client: &fcgiclient.Client{Dial: unreachable}},
+				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+					http.Error(w, "php is down", http.StatusServiceUnavailable)
+				},
+			},
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       "php is down\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			if rr.Code != tt.StatusCode || rr.Body.String() != tt.Body {
+				t.Fatalf("want %d %q got %d %q", tt.StatusCode, tt.Body, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
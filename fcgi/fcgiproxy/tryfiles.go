@@ -0,0 +1,44 @@
+package fcgiproxy
+
+import (
+	"app/fcgi/fcgiclient"
+	"os"
+	"path"
+	"strings"
+)
+
+// TryFiles resolves the script of a url path like nginx
+// try_files $uri $uri/ /index.php: an existing .php file of documentRoot
+// is run, a directory runs the first of indexes it holds, otherwise ok is
+// false and the Handler falls back to its Index. It is meant for
+// Handler.SplitPath.
+func TryFiles(documentRoot string, indexes ...string) fcgiclient.SplitPathFunc {
+	return func(urlPath string) (string, string, bool) {
+		name := path.Clean("/" + urlPath)
+		info, err := os.Stat(path.Join(documentRoot, name))
+		if err != nil {
+			return "", "", false
+		}
+		if info.Mode().IsRegular() && isScript(name) {
+			return name, "", true
+		}
+		if !info.IsDir() {
+			return "", "", false
+		}
+		for _, index := range indexes {
+			script := path.Join(name, index)
+			if !isScript(script) {
+				continue
+			}
+			info, err := os.Stat(path.Join(documentRoot, script))
+			if err == nil && info.Mode().IsRegular() {
+				return script, "", true
+			}
+		}
+		return "", "", false
+	}
+}
+
+func isScript(name string) bool {
+	return strings.HasSuffix(name, ".php")
+}
@@ -0,0 +1,72 @@
+package fcgiproxy
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTryFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"index.php", "admin/tools.php", "admin/index.php", "docs/index.html", "style.css"} {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0o755); err != nil {
+			t.Fatalf("cannot create folder of %s : %v", name, err)
+		}
+		if err := os.WriteFile(path.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatalf("cannot create %s : %v", name, err)
+		}
+	}
+	tryFiles := TryFiles(dir, "index.php")
+
+	tests := map[string]struct {
+		Path   string
+		Script string
+		Ok     bool
+	}{
+		"existing script": {
+			Path:   "/admin/tools.php",
+			Script: "/admin/tools.php",
+			Ok:     true,
+		},
+		"directory index": {
+			Path:   "/admin/",
+			Script: "/admin/index.php",
+			Ok:     true,
+		},
+		"directory without trailing slash": {
+			Path:   "/admin",
+			Script: "/admin/index.php",
+			Ok:     true,
+		},
+		"directory without php index": {
+			Path: "/docs/",
+			Ok:   false,
+		},
+		"missing script": {
+			Path: "/admin/missing.php",
+			Ok:   false,
+		},
+		"front controller route": {
+			Path: "/api/users",
+			Ok:   false,
+		},
+		"not a script": {
+			Path: "/style.css",
+			Ok:   false,
+		},
+		"cannot leave the document root": {
+			Path:   "/../../admin/tools.php",
+			Script: "/admin/tools.php",
+			Ok:     true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			script, pathInfo, ok := tryFiles(tt.Path)
+			if ok != tt.Ok || (ok && script != tt.Script) || pathInfo != "" {
+				t.Fatalf("want %s %v got %s %s %v", tt.Script, tt.Ok, script, pathInfo, ok)
+			}
+		})
+	}
+}
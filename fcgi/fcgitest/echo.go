@@ -0,0 +1,103 @@
+package fcgitest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EchoHandler answers like php-fpm/index.php: it echoes the uri, the
+// method, the headers and the body of the request. The status_code, throw
+// and die query parameters behave as in the script and a missing
+// SCRIPT_FILENAME gets the 404 php-fpm sends.
+func EchoHandler(w *ResponseWriter, r *Request) {
+	if _, err := os.Stat(r.Env["SCRIPT_FILENAME"]); err != nil {
+		fmt.Fprint(w.Stderr, "Primary script unknown")
+		fmt.Fprint(w, "Status: 404 Not Found\r\nContent-type: text/html; charset=UTF-8\r\n\r\nFile not found.\n")
+		return
+	}
+
+	query, _ := url.ParseQuery(r.Env["QUERY_STRING"])
+	headers := []string{}
+	if query.Has("throw") {
+		fmt.Fprint(w.Stderr, "PHP message: PHP Fatal error:  Uncaught Exception: throw exception")
+		fmt.Fprint(w, "Content-type: text/html; charset=UTF-8\r\n\r\n<br />\n<b>Fatal error</b>:  Uncaught Exception: throw exception<br />\n")
+		w.AppStatus = 255
+		return
+	}
+	if query.Has("die") {
+		fmt.Fprint(w, "Content-type: text/html; charset=UTF-8\r\n\r\n")
+		w.AppStatus = 1
+		return
+	}
+	if code := query.Get("status_code"); code != "" {
+		statusCode, _ := strconv.Atoi(code)
+		headers = append(headers,
+			fmt.Sprintf("Status: %d %s", statusCode, http.StatusText(statusCode)),
+			"Status-Code:"+code,
+			"X-Status-Code: "+code,
+		)
+	}
+	headers = append(headers,
+		"X-Request-Uri: "+r.Env["REQUEST_URI"],
+		"Content-type: text/html; charset=UTF-8",
+	)
+
+	body := []string{
+		"<h1>Requested URL:</h1>",
+		"<p>" + r.Env["REQUEST_URI"] + "</p>",
+		"<h1>Request Method:</h1>",
+		"<p>" + r.Env["REQUEST_METHOD"] + "</p>",
+		"<h1>Headers:</h1>",
+		"<pre>",
+	}
+	for _, key := range []string{"REMOTE_ADDR", "REMOTE_PORT", "SERVER_ADDR", "SERVER_NAME", "SERVER_PORT"} {
+		if value, ok := r.Env[key]; ok {
+			body = append(body, key+": "+value)
+		}
+	}
+	requestHeaders := allHeaders(r.Env)
+	names := make([]string, 0, len(requestHeaders))
+	for name := range requestHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		body = append(body, name+": "+requestHeaders[name])
+	}
+	body = append(body, "</pre>", "<h1>Body:</h1>", "<pre>", string(r.Stdin)+"</pre>")
+
+	fmt.Fprint(w, strings.Join(headers, "\r\n")+"\r\n\r\n"+strings.Join(body, "\n"))
+}
+
+// allHeaders rebuilds the request headers from the environment the way
+// php getallheaders does.
+func allHeaders(env map[string]string) map[string]string {
+	headers := map[string]string{}
+	for key, value := range env {
+		if name, ok := strings.CutPrefix(key, "HTTP_"); ok {
+			headers[headerName(name)] = value
+		}
+	}
+	for _, key := range []string{"CONTENT_TYPE", "CONTENT_LENGTH"} {
+		if value, ok := env[key]; ok {
+			headers[headerName(key)] = value
+		}
+	}
+	return headers
+}
+
+// headerName turns ACCEPT_ENCODING into Accept-Encoding.
+func headerName(key string) string {
+	words := strings.Split(strings.ToLower(key), "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "-")
+}
@@ -0,0 +1,30 @@
+package fcgitest
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+// DocumentRoot returns a temporary document root holding the index.php
+// the requests point to, it is removed once the test is over.
+func DocumentRoot(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := os.WriteFile(path.Join(dir, "index.php"), nil, 0o644)
+	if err != nil {
+		t.Fatalf("cannot create index.php : %v", err)
+	}
+	return dir
+}
+
+// MustUrl parses rawUrl and fails the test if it cannot.
+func MustUrl(t testing.TB, rawUrl string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatalf("cannot parse url %s : %v", rawUrl, err)
+	}
+	return u
+}
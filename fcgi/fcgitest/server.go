@@ -0,0 +1,463 @@
+// Package fcgitest provides an in-process FastCGI application for tests,
+// the same way net/http/httptest does for HTTP.
+package fcgitest
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Handler answers a request, what it writes to w is sent back to the
+// client as it is written.
+type Handler func(w *ResponseWriter, r *Request)
+
+type Request struct {
+	Id    uint16
+	Role  uint16
+	Flags uint8
+	// Env is Params as php sees them.
+	Env map[string]string
+	// Params are the params in the order they were received.
+	Params fcgiprotocol.Params
+	Stdin  []byte
+	// Data is the FCGI_DATA stream of an FCGI_FILTER request.
+	Data []byte
+	ctx  context.Context
+}
+
+// Context is done when the client aborts the request with
+// FCGI_ABORT_REQUEST, when the connection is lost or the server closed.
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+// ResponseWriter sends what is written to it as FCGI_STDOUT records and
+// what is written to Stderr as FCGI_STDERR records. AppStatus and
+// ProtocolStatus are sent in FCGI_END_REQUEST once the handler returns.
+type ResponseWriter struct {
+	AppStatus      uint32
+	ProtocolStatus uint8
+	Stderr         io.Writer
+	stdout         io.Writer
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	return w.stdout.Write(p)
+}
+
+// Server is a FastCGI application listening on a loopback TCP port or on
+// a Unix socket. Every record it receives is kept for assertions.
+type Server struct {
+	// Network is "tcp" or "unix", it can be changed before Start.
+	Network string
+	// Addr is the address to dial once the server started.
+	Addr string
+	// Multiplex lets the requests of a connection run concurrently, when
+	// false a request begun while another one runs on the same connection
+	// is rejected with FCGI_CANT_MPX_CONN as php-fpm does.
+	Multiplex bool
+	// Values are the variables answered to FCGI_GET_VALUES besides
+	// FCGI_MPXS_CONNS, which follows Multiplex.
+	Values map[string]string
+
+	handler  Handler
+	listener net.Listener
+	dir      string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.Conn]struct{}
+	records  []fcgiprotocol.Record
+	requests []Request
+}
+
+// NewServer starts a server listening on a loopback TCP port.
+func NewServer(handler Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server to configure before calling Start.
+func NewUnstartedServer(handler Handler) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		Network: "tcp",
+		handler: handler,
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// Start listens on a random loopback port or, for the unix network, on a
+// socket in a temporary directory. It panics if it cannot listen.
+func (s *Server) Start() {
+	if s.listener != nil {
+		panic("fcgitest: server already started")
+	}
+	address := "127.0.0.1:0"
+	if s.Network == "unix" {
+		dir, err := os.MkdirTemp("", "fcgitest")
+		if err != nil {
+			panic(fmt.Sprintf("fcgitest: cannot create socket dir : %v", err))
+		}
+		s.dir = dir
+		address = filepath.Join(dir, "fcgi.sock")
+	}
+	l, err := net.Listen(s.Network, address)
+	if err != nil {
+		panic(fmt.Sprintf("fcgitest: cannot listen on %s : %v", address, err))
+	}
+	s.listener = l
+	s.Addr = l.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Dial opens a connection to the server.
+func (s *Server) Dial() (net.Conn, error) {
+	return net.Dial(s.Network, s.Addr)
+}
+
+// Close stops the server, closes its connections and cancels the context
+// of running requests. It blocks until every handler returned.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// Records returns every record received so far, in order.
+func (s *Server) Records() []fcgiprotocol.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fcgiprotocol.Record{}, s.records...)
+}
+
+// Requests returns the requests handed to the handler so far, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		rwc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			rwc.Close()
+			return
+		}
+		s.conns[rwc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		c := &conn{
+			s:        s,
+			rwc:      rwc,
+			w:        fcgiprotocol.StreamRecordWriter(rwc, fcgiprotocol.MaxWrite),
+			requests: map[uint16]*pending{},
+		}
+		go c.serve()
+	}
+}
+
+func (s *Server) record(rec fcgiprotocol.Record) {
+	s.mu.Lock()
+	s.records = append(s.records, rec)
+	s.mu.Unlock()
+}
+
+func (s *Server) value(name string) (string, bool) {
+	if name == fcgiprotocol.FCGI_MPXS_CONNS {
+		if s.Multiplex {
+			return "1", true
+		}
+		return "0", true
+	}
+	value, ok := s.Values[name]
+	return value, ok
+}
+
+// start hands a request over to the handler, it reports false once the
+// server is closed.
+func (s *Server) start(req Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.requests = append(s.requests, req)
+	s.wg.Add(1)
+	return true
+}
+
+type pending struct {
+	records []fcgiprotocol.Record
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running bool
+	// stdinLeft is the part of CONTENT_LENGTH not received yet, it is
+	// negative until the params are over or when CONTENT_LENGTH is not set.
+	stdinLeft int
+	// filter is set for FCGI_FILTER requests, which run once the
+	// FCGI_DATA stream is closed.
+	filter bool
+}
+
+// complete reports whether the handler can run. Like php-fpm a request
+// with a CONTENT_LENGTH starts once that many bytes of stdin arrived, even
+// if the stdin stream is not closed yet.
+func (p *pending) complete(rec fcgiprotocol.Record) bool {
+	if p.filter {
+		return rec.Header.Type == fcgiprotocol.FCGI_DATA && len(rec.Content()) == 0
+	}
+	switch rec.Header.Type {
+	case fcgiprotocol.FCGI_PARAMS:
+		if len(rec.Content()) > 0 {
+			return false
+		}
+		decoded, err := fcgiprotocol.DecodeRequest(p.records)
+		if err != nil {
+			return true
+		}
+		if decoded.Role == uint16(fcgiprotocol.FCGI_FILTER) {
+			p.filter = true
+			return false
+		}
+		length, err := strconv.Atoi(decoded.Env.Get("CONTENT_LENGTH"))
+		if err != nil {
+			return false
+		}
+		p.stdinLeft = length
+		return p.stdinLeft <= 0
+	case fcgiprotocol.FCGI_STDIN:
+		if len(rec.Content()) == 0 {
+			return true
+		}
+		if p.stdinLeft < 0 {
+			return false
+		}
+		p.stdinLeft -= len(rec.Content())
+		return p.stdinLeft <= 0
+	}
+	return false
+}
+
+type conn struct {
+	s   *Server
+	rwc net.Conn
+
+	wmu sync.Mutex
+	w   func(recType uint8, reqId uint16, content []byte) error
+
+	mu       sync.Mutex
+	requests map[uint16]*pending
+}
+
+func (c *conn) serve() {
+	defer c.s.wg.Done()
+	defer func() {
+		c.s.mu.Lock()
+		delete(c.s.conns, c.rwc)
+		c.s.mu.Unlock()
+		c.mu.Lock()
+		for _, p := range c.requests {
+			p.cancel()
+		}
+		c.mu.Unlock()
+		c.rwc.Close()
+	}()
+	for {
+		rec := fcgiprotocol.Record{}
+		if err := rec.Read(c.rwc); err != nil {
+			return
+		}
+		c.s.record(rec)
+		if rec.Header.Id == uint16(fcgiprotocol.FCGI_NULL_REQUEST_ID) {
+			c.manage(rec)
+			continue
+		}
+		c.handle(rec)
+	}
+}
+
+// manage answers a management record, FCGI_GET_VALUES with the variables
+// the server knows among the ones asked and any other type with
+// FCGI_UNKNOWN_TYPE.
+func (c *conn) manage(rec fcgiprotocol.Record) {
+	if rec.Header.Type != fcgiprotocol.FCGI_GET_VALUES {
+		unknown := make([]byte, 8)
+		unknown[0] = rec.Header.Type
+		c.write(fcgiprotocol.FCGI_UNKNOWN_TYPE, 0, unknown)
+		return
+	}
+	result := fcgiprotocol.Params{}
+	pr := fcgiprotocol.NewPairReader(bytes.NewReader(rec.Content()))
+	for {
+		pair, err := pr.Next()
+		if err != nil {
+			break
+		}
+		if value, ok := c.s.value(pair.Key); ok {
+			result.Add(pair.Key, value)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := fcgiprotocol.BuildPair(buf, result); err != nil {
+		return
+	}
+	c.write(fcgiprotocol.FCGI_GET_VALUES_RESULT, 0, buf.Bytes())
+}
+
+func (c *conn) handle(rec fcgiprotocol.Record) {
+	reqId := rec.Header.Id
+	c.mu.Lock()
+	p, ok := c.requests[reqId]
+	switch rec.Header.Type {
+	case fcgiprotocol.FCGI_BEGIN_REQUEST:
+		if len(c.requests) > 0 && !c.s.Multiplex {
+			c.mu.Unlock()
+			c.end(reqId, 0, fcgiprotocol.FCGI_CANT_MPX_CONN)
+			return
+		}
+		ctx, cancel := context.WithCancel(c.s.ctx)
+		c.requests[reqId] = &pending{
+			records:   []fcgiprotocol.Record{rec},
+			ctx:       ctx,
+			cancel:    cancel,
+			stdinLeft: -1,
+		}
+	case fcgiprotocol.FCGI_PARAMS, fcgiprotocol.FCGI_STDIN, fcgiprotocol.FCGI_DATA:
+		if !ok || p.running {
+			break
+		}
+		p.records = append(p.records, rec)
+		if p.complete(rec) {
+			p.running = true
+			c.mu.Unlock()
+			c.run(reqId, p)
+			return
+		}
+	case fcgiprotocol.FCGI_ABORT_REQUEST:
+		if !ok {
+			break
+		}
+		p.cancel()
+		if !p.running {
+			delete(c.requests, reqId)
+			c.mu.Unlock()
+			c.end(reqId, 0, fcgiprotocol.FCGI_REQUEST_COMPLETE)
+			return
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *conn) run(reqId uint16, p *pending) {
+	decoded, err := fcgiprotocol.DecodeRequest(p.records)
+	if err != nil {
+		c.finish(reqId, p, 0, fcgiprotocol.FCGI_REQUEST_COMPLETE, false)
+		return
+	}
+	req := Request{
+		Id:     reqId,
+		Role:   decoded.Role,
+		Flags:  decoded.Flags,
+		Env:    decoded.Env.Map(),
+		Params: decoded.Env,
+		Stdin:  decoded.Stdin,
+		Data:   decoded.Data,
+		ctx:    p.ctx,
+	}
+	if !c.s.start(req) {
+		return
+	}
+	go func() {
+		defer c.s.wg.Done()
+		stderr := &stream{c: c, recType: fcgiprotocol.FCGI_STDERR, reqId: reqId}
+		w := &ResponseWriter{
+			Stderr: stderr,
+			stdout: &stream{c: c, recType: fcgiprotocol.FCGI_STDOUT, reqId: reqId},
+		}
+		c.s.handler(w, &req)
+		c.write(fcgiprotocol.FCGI_STDOUT, reqId, nil)
+		if stderr.used {
+			c.write(fcgiprotocol.FCGI_STDERR, reqId, nil)
+		}
+		c.finish(reqId, p, w.AppStatus, w.ProtocolStatus, req.Flags&fcgiprotocol.FCGI_KEEP_CONN == 0)
+	}()
+}
+
+// finish forgets the request before ending it so that the client can
+// begin the next one as soon as it reads FCGI_END_REQUEST.
+func (c *conn) finish(reqId uint16, p *pending, appStatus uint32, protocolStatus uint8, closeConn bool) {
+	p.cancel()
+	c.mu.Lock()
+	delete(c.requests, reqId)
+	c.mu.Unlock()
+	c.end(reqId, appStatus, protocolStatus)
+	if closeConn {
+		c.rwc.Close()
+	}
+}
+
+func (c *conn) end(reqId uint16, appStatus uint32, protocolStatus uint8) {
+	content := make([]byte, 8)
+	binary.BigEndian.PutUint32(content, appStatus)
+	content[4] = protocolStatus
+	c.write(fcgiprotocol.FCGI_END_REQUEST, reqId, content)
+}
+
+func (c *conn) write(recType uint8, reqId uint16, content []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.w(recType, reqId, content)
+}
+
+type stream struct {
+	c       *conn
+	recType uint8
+	reqId   uint16
+	used    bool
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.used = true
+	if err := s.c.write(s.recType, s.reqId, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,241 @@
+package fcgitest
+
+import (
+	"app/fcgi/fcgiprotocol"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	tests := map[string]struct {
+		Network string
+	}{
+		"tcp":  {Network: "tcp"},
+		"unix": {Network: "unix"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := NewUnstartedServer(func(w *ResponseWriter, r *Request) {
+				fmt.Fprint(w.Stderr, "warning")
+				fmt.Fprintf(w, "Content-type: text/plain\r\n\r\n%s %s", r.Env["REQUEST_METHOD"], r.Stdin)
+				w.AppStatus = 3
+			})
+			srv.Network = tt.Network
+			srv.Start()
+			defer srv.Close()
+
+			conn, err := srv.Dial()
+			if err != nil {
+				t.Fatalf("cannot dial : %v", err)
+			}
+			defer conn.Close()
+			rsp, err := fcgiprotocol.Do(conn, fcgiprotocol.Params{{Key: "REQUEST_METHOD", Value: "POST"}}, strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("failed running request : %v", err)
+			}
+			expected := fcgiprotocol.RawResponse{
+				Stdout:    []byte("Content-type: text/plain\r\n\r\nPOST body"),
+				Stderr:    []byte("warning"),
+				AppStatus: 3,
+			}
+			if !reflect.DeepEqual(rsp, expected) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", expected, rsp)
+			}
+
+			types := []uint8{}
+			for _, rec := range srv.Records() {
+				types = append(types, rec.Header.Type)
+			}
+			wantTypes := []uint8{
+				fcgiprotocol.FCGI_BEGIN_REQUEST,
+				fcgiprotocol.FCGI_PARAMS,
+				fcgiprotocol.FCGI_PARAMS,
+				fcgiprotocol.FCGI_STDIN,
+				fcgiprotocol.FCGI_STDIN,
+			}
+			if !reflect.DeepEqual(types, wantTypes) {
+				t.Fatalf("want records %v got %v", wantTypes, types)
+			}
+			requests := srv.Requests()
+			if len(requests) != 1 || requests[0].Role != uint16(fcgiprotocol.FCGI_RESPONDER) || string(requests[0].Stdin) != "body" {
+				t.Fatalf("unexpected requests %#v", requests)
+			}
+		})
+	}
+}
+
+func TestServerMultiplex(t *testing.T) {
+	tests := map[string]struct {
+		Multiplex    bool
+		Multiplexing bool
+	}{
+		"multiplexed": {
+			Multiplex:    true,
+			Multiplexing: true,
+		},
+		"refused": {
+			Multiplex:    false,
+			Multiplexing: false,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			srv := NewUnstartedServer(func(w *ResponseWriter, r *Request) {
+				if r.Env["SLOW"] != "" {
+					<-release
+				}
+				fmt.Fprint(w, "Content-type: text/plain\r\n\r\n"+r.Env["NAME"])
+			})
+			srv.Multiplex = tt.Multiplex
+			srv.Start()
+			defer srv.Close()
+
+			rwc, err := srv.Dial()
+			if err != nil {
+				t.Fatalf("cannot dial : %v", err)
+			}
+			conn := fcgiprotocol.NewConn(rwc)
+			defer conn.Close()
+
+			slow := make(chan error, 1)
+			go func() {
+				_, err := conn.Do(fcgiprotocol.Params{{Key: "NAME", Value: "slow"}, {Key: "SLOW", Value: "1"}}, nil)
+				slow <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(release)
+			}()
+			rsp, err := conn.Do(fcgiprotocol.Params{{Key: "NAME", Value: "fast"}}, nil)
+			if !tt.Multiplex {
+				if !errors.Is(err, fcgiprotocol.ErrCantMultiplex) {
+					t.Fatalf("want %v got %v", fcgiprotocol.ErrCantMultiplex, err)
+				}
+			} else if err != nil {
+				t.Fatalf("failed running request : %v", err)
+			} else if !strings.HasSuffix(string(rsp.Stdout), "fast") {
+				t.Fatalf("unexpected response %s", rsp.Stdout)
+			}
+			if err := <-slow; err != nil {
+				t.Fatalf("failed running slow request : %v", err)
+			}
+			if conn.Multiplexing() != tt.Multiplexing {
+				t.Fatalf("want multiplexing %v got %v", tt.Multiplexing, conn.Multiplexing())
+			}
+		})
+	}
+}
+
+func TestServerAbort(t *testing.T) {
+	aborted := make(chan struct{})
+	srv := NewServer(func(w *ResponseWriter, r *Request) {
+		<-r.Context().Done()
+		close(aborted)
+	})
+	defer srv.Close()
+
+	conn, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("cannot dial : %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fcgiprotocol.DoContext(ctx, conn, 0, fcgiprotocol.Params{}, nil)
+	if err == nil {
+		t.Fatalf("want request aborted got nil")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatalf("handler context was not canceled by FCGI_ABORT_REQUEST")
+	}
+}
+
+func TestServerTruncatedBeginRequest(t *testing.T) {
+	srv := NewServer(func(w *ResponseWriter, r *Request) {})
+	defer srv.Close()
+
+	conn, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("cannot dial : %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	write := fcgiprotocol.RawRecordWriter(conn)
+	for _, recType := range []uint8{fcgiprotocol.FCGI_BEGIN_REQUEST, fcgiprotocol.FCGI_PARAMS, fcgiprotocol.FCGI_STDIN} {
+		if err := write(recType, 1, nil); err != nil {
+			t.Fatalf("cannot write record : %v", err)
+		}
+	}
+	for {
+		rec := fcgiprotocol.Record{}
+		if err := rec.Read(conn); err != nil {
+			t.Fatalf("cannot read response : %v", err)
+		}
+		if rec.Header.Type == fcgiprotocol.FCGI_END_REQUEST {
+			break
+		}
+	}
+	requests := srv.Requests()
+	if len(requests) != 1 || requests[0].Role != 0 || requests[0].Flags != 0 {
+		t.Fatalf("unexpected requests %#v", requests)
+	}
+}
+
+func TestServerGetValues(t *testing.T) {
+	tests := map[string]struct {
+		Multiplex bool
+		Values    map[string]string
+		Expected  map[string]string
+	}{
+		"multiplexed": {
+			Multiplex: true,
+			Expected:  map[string]string{fcgiprotocol.FCGI_MPXS_CONNS: "1"},
+		},
+		"values": {
+			Values: map[string]string{fcgiprotocol.FCGI_MAX_CONNS: "4", "OTHER": "1"},
+			Expected: map[string]string{
+				fcgiprotocol.FCGI_MAX_CONNS:  "4",
+				fcgiprotocol.FCGI_MPXS_CONNS: "0",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := NewUnstartedServer(func(w *ResponseWriter, r *Request) {})
+			srv.Multiplex = tt.Multiplex
+			srv.Values = tt.Values
+			srv.Start()
+			defer srv.Close()
+
+			conn, err := srv.Dial()
+			if err != nil {
+				t.Fatalf("cannot dial : %v", err)
+			}
+			defer conn.Close()
+			values, err := fcgiprotocol.GetValues(
+				conn,
+				fcgiprotocol.FCGI_MAX_CONNS,
+				fcgiprotocol.FCGI_MAX_REQS,
+				fcgiprotocol.FCGI_MPXS_CONNS,
+			)
+			if err != nil {
+				t.Fatalf("cannot get values : %v", err)
+			}
+			if !reflect.DeepEqual(values, tt.Expected) {
+				t.Fatalf("want \n%#v\ngot \n%#v\n", tt.Expected, values)
+			}
+		})
+	}
+}
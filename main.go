@@ -4,6 +4,7 @@ import (
 	"app/cmd/client"
 	"app/cmd/server"
 	"app/cmd/sniff"
+	"app/cmd/values"
 	"fmt"
 	"os"
 	"strings"
@@ -21,6 +22,7 @@ func run() error {
 		server.Action: server.Run,
 		client.Action: client.Run,
 		sniff.Action:  sniff.Run,
+		values.Action: values.Run,
 	}
 
 	if len(os.Args) <= 1 {
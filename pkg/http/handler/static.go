@@ -2,14 +2,18 @@ package handler
 
 import (
 	"app/pkg/http/middleware"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 )
 
-func Static(folder, index string) func(w http.ResponseWriter, r *http.Request) bool {
+// Static serves the files of folder and reports whether it did, php
+// scripts and folders holding one of the php dirIndex are left to php.
+func Static(folder, index string, dirIndex ...string) func(w http.ResponseWriter, r *http.Request) bool {
 	h := http.NewServeMux()
 	h.Handle("/", http.FileServer(http.Dir(folder)))
 
@@ -18,12 +22,16 @@ func Static(folder, index string) func(w http.ResponseWriter, r *http.Request) b
 		if r.URL.Path == "/.env" || r.URL.Path == "/" || r.URL.Path == "" {
 			filename = path.Join(folder, index)
 		}
-		_, err := os.Stat(filename)
+		info, err := os.Stat(filename)
+		if err == nil && info.IsDir() && hasScript(filename, dirIndex) {
+			return false
+		}
 		if err == nil && !strings.HasSuffix(filename, ".php") {
 			h.ServeHTTP(w, r)
 			return true
 		}
-		if err != nil && !os.IsNotExist(err) {
+		// a path going through a file, like /app.php/users, is PATH_INFO
+		if err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
 			fmt.Printf("cannot stat %s : %v\n", filename, err)
 			middleware.Respond(w, "server error", 500, nil)
 			return true
@@ -31,3 +39,15 @@ func Static(folder, index string) func(w http.ResponseWriter, r *http.Request) b
 		return false
 	}
 }
+
+func hasScript(dir string, dirIndex []string) bool {
+	for _, index := range dirIndex {
+		if !strings.HasSuffix(index, ".php") {
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir, index)); err == nil {
+			return true
+		}
+	}
+	return false
+}
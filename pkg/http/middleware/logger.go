@@ -13,6 +13,11 @@ func HandleWithLogAndError(next func(w http.ResponseWriter, r *http.Request) ([]
 		ww := &wrapWriter{w: rw, statusCode: http.StatusOK}
 		startedAt := time.Now()
 		stderr, err := next(ww, r)
+		if err != nil && !ww.wroteHeader {
+			// once the response started streaming all we can do is to
+			// log the error
+			Respond(ww, "server error", 500, nil)
+		}
 		endedAt := time.Now()
 		logLine := struct {
 			At           time.Time
@@ -44,7 +49,6 @@ func HandleWithLogAndError(next func(w http.ResponseWriter, r *http.Request) ([]
 		if err != nil {
 			logLine.Level = "error"
 			logLine.ErrorMessage = err.Error()
-			Respond(rw, "server error", 500, nil)
 		}
 		_ = json.NewEncoder(os.Stdout).Encode(logLine)
 	}
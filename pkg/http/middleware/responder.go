@@ -2,13 +2,50 @@ package middleware
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 )
 
-func Respond(w http.ResponseWriter, body string, statusCode int, headers map[string]string) {
-	for header, value := range headers {
-		w.Header().Set(header, value)
-	}
+func Respond(w http.ResponseWriter, body string, statusCode int, headers http.Header) {
+	setHeaders(w, headers)
 	w.WriteHeader(statusCode)
 	fmt.Fprintf(w, "%s", body)
 }
+
+// RespondStream writes body as it is read and flushes after each read so
+// the client gets the output without waiting for the end of it.
+func RespondStream(w http.ResponseWriter, body io.Reader, statusCode int, headers http.Header) error {
+	setHeaders(w, headers)
+	w.WriteHeader(statusCode)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	flusher.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func setHeaders(w http.ResponseWriter, headers http.Header) {
+	for header, values := range headers {
+		w.Header().Del(header)
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+}
@@ -6,17 +6,25 @@ type wrapWriter struct {
 	w           http.ResponseWriter
 	statusCode  int
 	byteWritten int
+	wroteHeader bool
 }
 
 func (ww *wrapWriter) Header() http.Header {
 	return ww.w.Header()
 }
 func (ww *wrapWriter) Write(b []byte) (int, error) {
+	ww.wroteHeader = true
 	n, err := ww.w.Write(b)
 	ww.byteWritten += n
 	return n, err
 }
 func (ww *wrapWriter) WriteHeader(statusCode int) {
 	ww.statusCode = statusCode
+	ww.wroteHeader = true
 	ww.w.WriteHeader(statusCode)
 }
+func (ww *wrapWriter) Flush() {
+	if f, ok := ww.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
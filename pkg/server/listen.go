@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Listen is net.Listen removing the unix socket a previous run left
+// behind. A socket still accepting connections is kept so that two
+// processes do not steal each other's address.
+//
+// The socket file of a unix listener is removed when it is closed.
+func Listen(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("cannot listen on %s : socket already in use", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("cannot remove stale socket %s : %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	socket := path.Join(t.TempDir(), "fcgi.sock")
+
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot create socket : %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("stale socket should still exist : %v", err)
+	}
+
+	l, err := Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen over a stale socket : %v", err)
+	}
+	if _, err := Listen("unix", socket); err == nil {
+		t.Fatalf("want error listening on a socket in use got nil")
+	}
+	l.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("socket should be removed on close got %v", err)
+	}
+}
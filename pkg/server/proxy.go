@@ -1,13 +1,47 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 )
 
 type DialFunc func() (io.ReadWriteCloser, error)
 
-func Proxy[T any](dial DialFunc, clientToServer, serverToClient Pipe[T], printf func(msg string, args ...interface{})) Hanlder {
+// Stream copies what Reader reads to Writer one item at a time, each item
+// is given to Observe before it is written.
+type Stream[T any] struct {
+	Reader  func(r io.Reader) (T, error)
+	Writer  func(w io.Writer, data T) error
+	Observe func(data T)
+}
+
+// Copy runs until r is over, which is not an error. An error wrapping
+// net.ErrClosed means a connection was closed under it.
+func (s *Stream[T]) Copy(r io.Reader, w io.Writer) error {
+	for {
+		data, err := s.Reader(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if s.Observe != nil {
+			s.Observe(data)
+		}
+		if err := s.Writer(w, data); err != nil {
+			return err
+		}
+	}
+}
+
+// Duplex is a Hanlder copying both directions at the same time, so the
+// server can answer before the request is over and a connection carries
+// as many requests as the client sends. It returns once either side
+// closed the connection.
+func Duplex[T any](dial DialFunc, clientToServer, serverToClient Stream[T], printf func(msg string, args ...interface{})) Hanlder {
 	return func(clientConn io.ReadWriter) error {
 		serverConn, err := dial()
 		if err != nil {
@@ -16,16 +50,40 @@ func Proxy[T any](dial DialFunc, clientToServer, serverToClient Pipe[T], printf
 		defer serverConn.Close()
 		printf("connected to server\n")
 
-		err = clientToServer.Run(clientConn, serverConn, "request", printf)
-		if err != nil {
-			return err
-		}
+		errs := make(chan error, 2)
+		go func() {
+			err := clientToServer.Copy(clientConn, serverConn)
+			if errors.Is(err, net.ErrClosed) {
+				// the client connection was closed by Run stopping
+				serverConn.Close()
+				err = nil
+			} else {
+				// the server still answers what it got
+				closeWrite(serverConn)
+			}
+			errs <- err
+		}()
+		go func() {
+			err := serverToClient.Copy(serverConn, clientConn)
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			closeWrite(clientConn)
+			if c, ok := clientConn.(io.Closer); ok {
+				c.Close()
+			}
+			errs <- err
+		}()
+		return errors.Join(<-errs, <-errs)
+	}
+}
 
-		printf("finish writing to server, waiting for response\n")
-		err = serverToClient.Run(serverConn, clientConn, "response", printf)
-		if err != nil {
-			return err
-		}
-		return nil
+func closeWrite(conn any) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	if c, ok := conn.(io.Closer); ok {
+		c.Close()
 	}
 }
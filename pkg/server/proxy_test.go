@@ -5,7 +5,6 @@ import (
 	"errors"
 	"io"
 	"log"
-	"strings"
 	"testing"
 )
 
@@ -34,10 +33,6 @@ func (m *mockConn) Close() error {
 	return nil
 }
 
-func mockDialFunc() (io.ReadWriteCloser, error) {
-	return newMockConn("response data"), nil
-}
-
 func mockFailDialFunc() (io.ReadWriteCloser, error) {
 	return nil, errors.New("dial error")
 }
@@ -51,67 +46,68 @@ func WriteAllError(w io.Writer, data []byte) error {
 	return errors.New("pipe error")
 }
 
-func TestHandleConnection_Success(t *testing.T) {
+// readChunk reads at most 4 bytes so a stream is copied in several items.
+func readChunk(r io.Reader) ([]byte, error) {
+	b := make([]byte, 4)
+	n, err := r.Read(b)
+	if n > 0 {
+		return b[:n], nil
+	}
+	return nil, err
+}
+
+func TestDuplex(t *testing.T) {
 	out := &bytes.Buffer{}
-	clientConn := newMockConn("request data")
 	l := log.New(out, "", 0)
-	handler := Proxy[[]byte](mockDialFunc,
-		Pipe[[]byte]{Reader: io.ReadAll, Writer: WriteAll},
-		Pipe[[]byte]{Reader: io.ReadAll, Writer: WriteAll},
-		func(msg string, args ...interface{}) { l.Printf(msg, args...) },
+	clientConn := newMockConn("request data")
+	serverConn := newMockConn("response data")
+	var requests, responses []string
+	handler := Duplex[[]byte](
+		func() (io.ReadWriteCloser, error) { return serverConn, nil },
+		Stream[[]byte]{Reader: readChunk, Writer: WriteAll, Observe: func(b []byte) { requests = append(requests, string(b)) }},
+		Stream[[]byte]{Reader: readChunk, Writer: WriteAll, Observe: func(b []byte) { responses = append(responses, string(b)) }},
+		l.Printf,
 	)
 
-	err := handler(clientConn)
-	if err != nil {
-		t.Fatalf("HandleConnection returned an error: %v", err)
+	if err := handler(clientConn); err != nil {
+		t.Fatalf("Duplex returned an error: %v", err)
 	}
-
-	expected := "response data"
-	if clientConn.writeBuf.String() != expected {
-		t.Errorf("Expected client write buffer to be %q, but got %q", expected, clientConn.writeBuf.String())
+	if serverConn.writeBuf.String() != "request data" {
+		t.Errorf("want server to get %q got %q", "request data", serverConn.writeBuf.String())
+	}
+	if clientConn.writeBuf.String() != "response data" {
+		t.Errorf("want client to get %q got %q", "response data", clientConn.writeBuf.String())
 	}
-	expectedLog := strings.Join([]string{
-		"connected to server",
-		"request read raw \"cmVxdWVzdCBkYXRh\"",
-		"writing back request",
-		"finish writing to server, waiting for response",
-		"response read raw \"cmVzcG9uc2UgZGF0YQ==\"",
-		"writing back response",
-		"",
-	}, "\n")
-	if out.String() != expectedLog {
-		t.Errorf("Expected log \n%s\n, but got \n%s\n", expectedLog, out.String())
+	if len(requests) != 3 || len(responses) != 4 {
+		t.Errorf("want every chunk observed got %q and %q", requests, responses)
+	}
+	if out.String() != "connected to server\n" {
+		t.Errorf("unexpected log %q", out.String())
 	}
 }
 
-func TestHandleConnection_DialError(t *testing.T) {
-	out := &bytes.Buffer{}
-	clientConn := newMockConn("request data")
-	l := log.New(out, "", 0)
-	handler := Proxy(mockFailDialFunc,
-		Pipe[[]byte]{Reader: io.ReadAll, Writer: WriteAll},
-		Pipe[[]byte]{Reader: io.ReadAll, Writer: WriteAll},
-		func(msg string, args ...interface{}) { l.Printf(msg, args...) },
+func TestDuplexPipeError(t *testing.T) {
+	handler := Duplex[[]byte](
+		func() (io.ReadWriteCloser, error) { return newMockConn("response data"), nil },
+		Stream[[]byte]{Reader: readChunk, Writer: WriteAllError},
+		Stream[[]byte]{Reader: readChunk, Writer: WriteAll},
+		func(msg string, args ...interface{}) {},
 	)
-
-	err := handler(clientConn)
-	if err == nil || err.Error() != "error connecting to PHP-FPM: dial error" {
-		t.Fatalf("Expected dial error, but got: %v", err)
+	err := handler(newMockConn("request data"))
+	if err == nil || err.Error() != "pipe error" {
+		t.Fatalf("want pipe error got %v", err)
 	}
 }
 
-func TestHandleConnection_PipeRunError(t *testing.T) {
-	out := &bytes.Buffer{}
-	clientConn := newMockConn("request data")
-	l := log.New(out, "", 0)
-	handler := Proxy(mockDialFunc,
-		Pipe[[]byte]{Reader: io.ReadAll, Writer: WriteAll},
-		Pipe[[]byte]{Reader: io.ReadAll, Writer: WriteAllError},
-		func(msg string, args ...interface{}) { l.Printf(msg, args...) },
+func TestDuplexDialError(t *testing.T) {
+	handler := Duplex[[]byte](
+		mockFailDialFunc,
+		Stream[[]byte]{Reader: readChunk, Writer: WriteAll},
+		Stream[[]byte]{Reader: readChunk, Writer: WriteAll},
+		func(msg string, args ...interface{}) {},
 	)
-
-	err := handler(clientConn)
-	if err == nil || err.Error() != "pipe error" {
-		t.Fatalf("Expected pipe error, but got: %v", err)
+	err := handler(newMockConn("request data"))
+	if err == nil || err.Error() != "error connecting to PHP-FPM: dial error" {
+		t.Fatalf("want dial error got %v", err)
 	}
 }
@@ -8,8 +8,13 @@ import (
 
 type Hanlder func(clientConn io.ReadWriter) error
 
+// Run serves the connections of listener with handler until done is
+// closed. It then closes the listener and the connections still open,
+// kept alive ones included, and waits for their handlers to return.
 func Run(done <-chan struct{}, listener net.Listener, handler Hanlder, printf func(msg string, args ...interface{})) {
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := map[net.Conn]struct{}{}
 
 	connChan := make(chan net.Conn)
 	errChan := make(chan error)
@@ -18,10 +23,18 @@ func Run(done <-chan struct{}, listener net.Listener, handler Hanlder, printf fu
 		for {
 			clientConn, err := listener.Accept()
 			if err != nil {
-				errChan <- err
+				select {
+				case errChan <- err:
+				case <-done:
+				}
+				return
+			}
+			select {
+			case connChan <- clientConn:
+			case <-done:
+				clientConn.Close()
 				return
 			}
-			connChan <- clientConn
 		}
 	}()
 
@@ -29,13 +42,27 @@ func Run(done <-chan struct{}, listener net.Listener, handler Hanlder, printf fu
 		select {
 		case <-done:
 			printf("context done, stopping listener accept loop")
+			listener.Close()
+			mu.Lock()
+			for conn := range conns {
+				conn.Close()
+			}
+			mu.Unlock()
 			wg.Wait()
 			return
 		case clientConn := <-connChan:
 			wg.Add(1)
+			mu.Lock()
+			conns[clientConn] = struct{}{}
+			mu.Unlock()
 			go func() {
 				defer wg.Done()
-				defer clientConn.Close()
+				defer func() {
+					mu.Lock()
+					delete(conns, clientConn)
+					mu.Unlock()
+					clientConn.Close()
+				}()
 				printf("handling new TCP client\n")
 				err := handler(clientConn)
 				if err != nil {
@@ -67,3 +67,43 @@ func TestRun(t *testing.T) {
 		t.Fatal("Server did not shut down as expected")
 	}
 }
+
+func TestRunClosesIdleConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error creating listener: %v", err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	// the handler serves the connection until the client closes it, like
+	// a kept alive FastCGI connection
+	handler := func(conn io.ReadWriter) error {
+		_, err := io.Copy(io.Discard, conn)
+		return err
+	}
+	go func() {
+		Run(done, listener, handler, func(msg string, args ...interface{}) {})
+		close(stopped)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing to listener: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return with an idle connection open")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want the idle connection closed got %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatal("want the listener closed")
+	}
+}